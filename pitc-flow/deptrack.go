@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Matches UUIDs e.g. 12345678-1234-1234-1234-123456789012
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Image executing the requests to the Dependency-Track REST API
+const curlImage = "curlimages/curl"
+
+// Dependency-Track REST API client, the requests are executed with curl in a dedicated container
+type deptrack struct {
+	// base URL e.g. https://deptrack.example.com
+	baseURL string
+	// API key
+	apiKey *dagger.Secret
+	// optional service bound to the host of the base URL e.g. a local instance
+	service *dagger.Service
+}
+
+// Response of the Dependency-Track REST API
+type deptrackResponse struct {
+	// HTTP status code
+	status int
+	// response body
+	body string
+}
+
+// Dependency-Track project identified either by its UUID or by its name and version
+type deptrackProject struct {
+	uuid    string
+	name    string
+	version string
+	// parent project UUID or name
+	parent string
+	tags   []string
+	// create the project (version) if it does not exist yet
+	autoCreate bool
+}
+
+// Creates the project, the version defaults to the tag of the registry address registry/repository/image:tag,
+// a project identified by its name requires a version if the image is not published
+func newDeptrackProject(uuid string, name string, version string, parent string, tags []string, autoCreate bool, registryAddress string) (deptrackProject, error) {
+	if uuid == "" && name != "" && version == "" {
+		if registryAddress == "" {
+			return deptrackProject{}, fmt.Errorf("the deptrack project %q requires a version if the image is not published", name)
+		}
+		_, version = splitImageAddress(registryAddress)
+	}
+	return deptrackProject{uuid: uuid, name: name, version: version, parent: parent, tags: tags, autoCreate: autoCreate}, nil
+}
+
+// Returns true if the project is identified by its UUID or name
+func (p deptrackProject) isSet() bool {
+	return p.uuid != "" || p.name != ""
+}
+
+// Creates a client, the address is either the base URL or the BOM endpoint e.g. https://deptrack.example.com/api/v1/bom
+func newDeptrack(address string, apiKey *dagger.Secret, service *dagger.Service) *deptrack {
+	baseURL := strings.TrimSuffix(address, "/")
+	baseURL = strings.TrimSuffix(baseURL, "/api/v1/bom")
+	return &deptrack{baseURL: baseURL, apiKey: apiKey, service: service}
+}
+
+// Executes the request, responses with a status other than 2xx are returned as error containing the status and the body
+func (c *deptrack) request(
+	ctx context.Context,
+	// HTTP method e.g. "PUT"
+	method string,
+	// path of the API endpoint e.g. "/api/v1/bom"
+	path string,
+	// JSON request body, empty for none
+	body string,
+) (*deptrackResponse, error) {
+	// the API key is only ever passed as secret variable and expanded by the shell
+	script := `method="$1"; shift; curl -sS -o /tmp/response -w '%{http_code}' -X "$method" -H "X-Api-Key: ${DT_API_KEY}" -H 'Accept: application/json' "$@"`
+	args := []string{"sh", "-c", script, "curl", method}
+	container := toolContainer(curlImage).
+		WithSecretVariable("DT_API_KEY", c.apiKey).
+		// the requests must never be cached e.g. when polling
+		WithEnvVariable("CACHE_BUSTER", time.Now().String())
+	if c.service != nil {
+		baseURL, err := url.Parse(c.baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deptrack address %q: %w", c.baseURL, err)
+		}
+		container = container.WithServiceBinding(baseURL.Hostname(), c.service)
+	}
+	if body != "" {
+		container = container.WithNewFile("/tmp/request.json", body)
+		args = append(args, "-H", "Content-Type: application/json", "--data-binary", "@/tmp/request.json")
+	}
+	container = container.WithExec(append(args, c.baseURL+path))
+
+	statusCode, err := container.Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %w", method, path, err)
+	}
+	status, err := strconv.Atoi(strings.TrimSpace(statusCode))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s returned an invalid status %q", method, path, statusCode)
+	}
+	responseBody, err := container.File("/tmp/response").Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	response := &deptrackResponse{status: status, body: responseBody}
+	if status < 200 || status > 299 {
+		return response, fmt.Errorf("%s %s responded with HTTP %d %s: %s", method, path, status, http.StatusText(status), responseBody)
+	}
+	return response, nil
+}
+
+// Uploads the CycloneDX SBOM to the project and returns the response containing the processing token
+func (c *deptrack) uploadBom(
+	ctx context.Context,
+	// CycloneDX SBOM
+	sbom *dagger.File,
+	// project to upload to
+	project deptrackProject,
+) (*deptrackResponse, error) {
+	content, err := sbom.Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request := map[string]any{
+		"bom": base64.StdEncoding.EncodeToString([]byte(content)),
+	}
+	if project.uuid != "" {
+		request["project"] = project.uuid
+	} else {
+		request["projectName"] = project.name
+		request["projectVersion"] = project.version
+		request["autoCreate"] = project.autoCreate
+	}
+	if uuidPattern.MatchString(project.parent) {
+		request["parentUUID"] = project.parent
+	} else if project.parent != "" {
+		request["parentName"] = project.parent
+	}
+	if len(project.tags) > 0 {
+		tags := make([]map[string]string, 0, len(project.tags))
+		for _, tag := range project.tags {
+			tags = append(tags, map[string]string{"name": tag})
+		}
+		request["projectTags"] = tags
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	return c.request(ctx, http.MethodPut, "/api/v1/bom", string(payload))
+}
+
+// Interval between two requests when waiting for deptrack to process a SBOM
+const deptrackPollInterval = 5 * time.Second
+
+// Waits until the SBOM of the upload with the provided processing token is processed
+func (c *deptrack) waitForProcessing(ctx context.Context, token string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		response, err := c.request(ctx, http.MethodGet, "/api/v1/bom/token/"+url.PathEscape(token), "")
+		if err != nil {
+			return err
+		}
+		var status struct {
+			Processing bool `json:"processing"`
+		}
+		if err := json.Unmarshal([]byte(response.body), &status); err != nil {
+			return fmt.Errorf("failed to parse the processing status: %w", err)
+		}
+		if !status.Processing {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the SBOM was not processed within %s", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(deptrackPollInterval):
+		}
+	}
+}
+
+// Returns the UUID of the project, projects without UUID are looked up by name and version
+func (c *deptrack) projectUUID(ctx context.Context, project deptrackProject) (string, error) {
+	if project.uuid != "" {
+		return project.uuid, nil
+	}
+	query := url.Values{"name": {project.name}, "version": {project.version}}
+	response, err := c.request(ctx, http.MethodGet, "/api/v1/project/lookup?"+query.Encode(), "")
+	if err != nil {
+		return "", err
+	}
+	var found struct {
+		UUID string `json:"uuid"`
+	}
+	if err := json.Unmarshal([]byte(response.body), &found); err != nil {
+		return "", fmt.Errorf("failed to parse the project: %w", err)
+	}
+	return found.UUID, nil
+}
+
+// Deptrack severities ordered from the lowest to the highest
+var deptrackSeverities = []string{"UNASSIGNED", "INFO", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// Deptrack policy violation states ordered from the lowest to the highest
+var deptrackViolationStates = []string{"INFO", "WARN", "FAIL"}
+
+// Configuration of the deptrack gate
+type deptrackGate struct {
+	// maximum time to wait for the SBOM to be processed
+	timeout time.Duration
+	// minimum severity of the findings failing the gate, empty if findings do not fail the gate
+	severity string
+	// minimum state of the policy violations failing the gate, empty if violations do not fail the gate
+	violationState string
+}
+
+// Relevant parts of a deptrack finding
+type deptrackFinding struct {
+	Component struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"component"`
+	Vulnerability struct {
+		VulnID   string `json:"vulnId"`
+		Severity string `json:"severity"`
+	} `json:"vulnerability"`
+	Analysis struct {
+		IsSuppressed bool `json:"isSuppressed"`
+	} `json:"analysis"`
+}
+
+// Relevant parts of a deptrack policy violation
+type deptrackViolation struct {
+	Component struct {
+		Name string `json:"name"`
+	} `json:"component"`
+	PolicyCondition struct {
+		Policy struct {
+			Name           string `json:"name"`
+			ViolationState string `json:"violationState"`
+		} `json:"policy"`
+	} `json:"policyCondition"`
+	Analysis struct {
+		IsSuppressed bool `json:"isSuppressed"`
+	} `json:"analysis"`
+}
+
+// Creates the deptrack gate configuration, returns nil if deptrack should not be waited for
+func newDeptrackGate(
+	// wait until deptrack processed the SBOM
+	wait bool,
+	// maximum time in seconds to wait, defaults to 300
+	timeout int,
+	// minimum severity of the findings failing the gate e.g. "HIGH"
+	severity string,
+	// minimum state of the policy violations failing the gate e.g. "FAIL"
+	violationState string,
+	// the SBOM is uploaded to deptrack i.e. its address, API key and project are set
+	upload bool,
+) (*deptrackGate, error) {
+	if !wait {
+		if severity != "" || violationState != "" {
+			return nil, fmt.Errorf("the deptrack severity and violation state only fail the run when waiting for deptrack")
+		}
+		return nil, nil
+	}
+	if !upload {
+		return nil, fmt.Errorf("waiting for deptrack requires its address, API key and project to upload the SBOM")
+	}
+	if timeout <= 0 {
+		timeout = 300
+	}
+	gate := &deptrackGate{
+		timeout:        time.Duration(timeout) * time.Second,
+		severity:       strings.ToUpper(severity),
+		violationState: strings.ToUpper(violationState),
+	}
+	if gate.severity != "" && !slices.Contains(deptrackSeverities, gate.severity) {
+		return nil, fmt.Errorf("invalid deptrack severity %q, expected one of %v", severity, deptrackSeverities)
+	}
+	if gate.violationState != "" && !slices.Contains(deptrackViolationStates, gate.violationState) {
+		return nil, fmt.Errorf("invalid deptrack violation state %q, expected one of %v", violationState, deptrackViolationStates)
+	}
+	return gate, nil
+}
+
+// Waits for deptrack to process the uploaded SBOM and evaluates the findings and policy violations of the project,
+// the findings and violations are returned as JSON even if the gate fails
+func (m *PitcFlow) deptrackGate(
+	ctx context.Context,
+	client *deptrack,
+	// project the SBOM was uploaded to
+	project deptrackProject,
+	// response body of the SBOM upload containing the processing token
+	uploadResponse string,
+	// gate configuration
+	gate *deptrackGate,
+) (string, string, error) {
+	var upload struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(uploadResponse), &upload); err != nil || upload.Token == "" {
+		return "", "", fmt.Errorf("the SBOM upload did not return a processing token: %s", uploadResponse)
+	}
+	if err := client.waitForProcessing(ctx, upload.Token, gate.timeout); err != nil {
+		return "", "", err
+	}
+	uuid, err := client.projectUUID(ctx, project)
+	if err != nil {
+		return "", "", err
+	}
+	findings, err := client.request(ctx, http.MethodGet, "/api/v1/finding/project/"+url.PathEscape(uuid), "")
+	if err != nil {
+		return "", "", err
+	}
+	violations, err := client.request(ctx, http.MethodGet, "/api/v1/violation/project/"+url.PathEscape(uuid), "")
+	if err != nil {
+		return findings.body, "", err
+	}
+	return findings.body, violations.body, gate.evaluate(findings.body, violations.body)
+}
+
+// Evaluates the findings and policy violations of a project against the gate
+func (gate *deptrackGate) evaluate(findingsJSON string, violationsJSON string) error {
+	var findings []deptrackFinding
+	if err := json.Unmarshal([]byte(findingsJSON), &findings); err != nil {
+		return fmt.Errorf("failed to parse the deptrack findings: %w", err)
+	}
+	var violations []deptrackViolation
+	if err := json.Unmarshal([]byte(violationsJSON), &violations); err != nil {
+		return fmt.Errorf("failed to parse the deptrack policy violations: %w", err)
+	}
+
+	var reasons []string
+	if gate.severity != "" {
+		var blocking []string
+		for _, finding := range findings {
+			severity := strings.ToUpper(finding.Vulnerability.Severity)
+			if !finding.Analysis.IsSuppressed && slices.Index(deptrackSeverities, severity) >= slices.Index(deptrackSeverities, gate.severity) {
+				blocking = append(blocking, fmt.Sprintf("%s (%s, %s@%s)", finding.Vulnerability.VulnID, severity, finding.Component.Name, finding.Component.Version))
+			}
+		}
+		if len(blocking) > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d findings with severity %s or higher: %s", len(blocking), gate.severity, strings.Join(blocking, ", ")))
+		}
+	}
+	if gate.violationState != "" {
+		var blocking []string
+		for _, violation := range violations {
+			policy := violation.PolicyCondition.Policy
+			state := strings.ToUpper(policy.ViolationState)
+			if !violation.Analysis.IsSuppressed && slices.Index(deptrackViolationStates, state) >= slices.Index(deptrackViolationStates, gate.violationState) {
+				blocking = append(blocking, fmt.Sprintf("%s (%s, %s)", policy.Name, state, violation.Component.Name))
+			}
+		}
+		if len(blocking) > 0 {
+			reasons = append(reasons, fmt.Sprintf("%d policy violations with state %s or higher: %s", len(blocking), gate.violationState, strings.Join(blocking, ", ")))
+		}
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("deptrack gate failed: %s", strings.Join(reasons, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// A pipeline step which is evaluated by the executor
+type step struct {
+	// name of the step e.g. "lint"
+	name string
+	// step is not executed but recorded as skipped
+	skip bool
+	// a failure of the step is recorded but does not fail the pipeline
+	soft bool
+	// forces the evaluation of the step
+	run func(ctx context.Context) error
+}
+
+// The outcome of an evaluated step
+type stepOutcome struct {
+	name      string
+	skipped   bool
+	soft      bool
+	err       error
+	startedAt time.Time
+	duration  time.Duration
+}
+
+// Evaluates all the provided steps concurrently and returns their outcomes once every step is done
+func runSteps(ctx context.Context, steps ...step) []stepOutcome {
+	outcomes := make([]stepOutcome, len(steps))
+	var g errgroup.Group
+	for i, s := range steps {
+		if s.skip {
+			outcomes[i] = stepOutcome{name: s.name, skipped: true}
+			continue
+		}
+		g.Go(func() error {
+			startedAt := time.Now()
+			err := s.run(ctx)
+			outcomes[i] = stepOutcome{name: s.name, soft: s.soft, err: err, startedAt: startedAt, duration: time.Since(startedAt)}
+			// a failing step must not cancel the others, every outcome is collected
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return outcomes
+}
+
+// Runs the provided functions concurrently within a single step and returns the first error
+func runAll[T any](ctx context.Context, items []T, fn func(ctx context.Context, item T) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	for _, item := range items {
+		g.Go(func() error {
+			return fn(ctx, item)
+		})
+	}
+	return g.Wait()
+}
+
+// Returns the outcome of the step with the provided name
+func outcomeOf(outcomes []stepOutcome, name string) stepOutcome {
+	for _, outcome := range outcomes {
+		if outcome.name == name {
+			return outcome
+		}
+	}
+	return stepOutcome{name: name, skipped: true}
+}
+
+// Returns true if the step with the provided name was executed successfully
+func passed(outcomes []stepOutcome, name string) bool {
+	outcome := outcomeOf(outcomes, name)
+	return !outcome.skipped && outcome.err == nil
+}
+
+// Combines the errors of all the failed steps into a single error, soft failures are ignored
+func stepsError(outcomes []stepOutcome) error {
+	var errs []error
+	for _, outcome := range outcomes {
+		if outcome.err != nil && !outcome.soft {
+			errs = append(errs, fmt.Errorf("%s: %w", outcome.name, outcome.err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -3,7 +3,11 @@ package main
 import (
 	"context"
 	"dagger/pitc-flow/internal/dagger"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 	"sync"
 )
 
@@ -47,75 +51,313 @@ func (m *PitcFlow) sast(
 	return container.Directory(results)
 }
 
+// Options for building the container image
+type buildOptions struct {
+	// path of the Dockerfile within the source directory
+	dockerfile string
+	// target stage of the Dockerfile
+	target string
+	// build arguments
+	args []dagger.BuildArg
+	// secrets available during the build
+	secrets []*dagger.Secret
+	// platforms to build the image for, empty for the default platform
+	platforms []dagger.Platform
+}
+
+// Creates the build options, the build arguments are formatted as NAME=VALUE
+func newBuildOptions(dockerfile string, target string, args []string, secrets []*dagger.Secret, platforms []string) (buildOptions, error) {
+	opts := buildOptions{dockerfile: dockerfile, target: target, secrets: secrets}
+	for _, platform := range platforms {
+		opts.platforms = append(opts.platforms, dagger.Platform(platform))
+	}
+	for _, arg := range args {
+		name, value, found := strings.Cut(arg, "=")
+		if !found || name == "" {
+			return opts, fmt.Errorf("invalid build argument %q, expected NAME=VALUE", arg)
+		}
+		opts.args = append(opts.args, dagger.BuildArg{Name: name, Value: value})
+	}
+	return opts, nil
+}
+
+// A platform variant of the app container image
+type imageVariant struct {
+	// platform of the variant e.g. "linux/arm64", empty for a single platform image
+	platform dagger.Platform
+	// app container
+	container *dagger.Container
+	// SBOMs of the container, the very same SBOMs are scanned, attested and uploaded
+	sboms []sbomFile
+	// vulnerability scan report of the first SBOM
+	vulnerabilityScan *dagger.File
+	// CycloneDX SBOM merged with the source SBOM, nil if not merged
+	mergedSbom *dagger.File
+}
+
+// Creates the image variant of the container, the SBOMs and the vulnerability scan are derived from it
+func (m *PitcFlow) newImageVariant(platform dagger.Platform, container *dagger.Container, formats []sbomFormat) *imageVariant {
+	variant := &imageVariant{
+		platform:  platform,
+		container: container,
+	}
+	for _, format := range formats {
+		variant.sboms = append(variant.sboms, sbomFile{format: format, file: m.sbom(container, format)})
+	}
+	variant.vulnerabilityScan = m.vulnscan(variant.sboms[0].file)
+	return variant
+}
+
+// Returns the SBOM of the variant in the provided format, nil if it was not created
+func (v *imageVariant) sbomOf(format string) *dagger.File {
+	return findSbom(v.sboms, format)
+}
+
+// Returns the directory name of the variant within the results e.g. "linux-arm64/", empty for a single platform image
+func (v *imageVariant) resultsDir() string {
+	if v.platform == "" {
+		return ""
+	}
+	return strings.ReplaceAll(string(v.platform), "/", "-") + "/"
+}
+
+// Builds one image variant for each of the platforms, a single variant for the default platform if none is provided
+func (m *PitcFlow) buildVariants(ctx context.Context, dir *dagger.Directory, opts buildOptions, formats []sbomFormat) []*imageVariant {
+	platforms := opts.platforms
+	if len(platforms) == 0 {
+		platforms = []dagger.Platform{""}
+	}
+	variants := make([]*imageVariant, 0, len(platforms))
+	for _, platform := range platforms {
+		variants = append(variants, m.newImageVariant(platform, m.build(ctx, dir, opts, platform), formats))
+	}
+	return variants
+}
+
 // Returns a Container built from the Dockerfile in the provided Directory
-func (m *PitcFlow) build(_ context.Context, dir *dagger.Directory) *dagger.Container {
+func (m *PitcFlow) build(
+	_ context.Context,
+	dir *dagger.Directory,
+	opts buildOptions,
+	// platform to build for, empty for the default platform
+	platform dagger.Platform,
+) *dagger.Container {
 	return dag.Container().
 		WithDirectory("/src", dir).
 		WithWorkdir("/src").
 		Directory("/src").
-		DockerBuild()
+		DockerBuild(dagger.DirectoryDockerBuildOpts{
+			Platform:   platform,
+			Dockerfile: opts.dockerfile,
+			Target:     opts.target,
+			BuildArgs:  opts.args,
+			Secrets:    opts.secrets,
+		})
 }
 
-// Builds the container and creates a SBOM for it
-func (m *PitcFlow) sbomBuild(ctx context.Context, dir *dagger.Directory) *dagger.File {
-	container := m.build(ctx, dir)
-	return m.sbom(container)
+// A SBOM format supported by the pipeline
+type sbomFormat struct {
+	// name of the format e.g. "spdx"
+	name string
+	// Trivy report format
+	report string
+	// file name of the SBOM within the results
+	fileName string
+	// cosign attestation predicate type
+	predicateType string
 }
 
-// Creates a SBOM for the container
-func (m *PitcFlow) sbom(container *dagger.Container) *dagger.File {
-	trivy_container := dag.Container().
-		From("aquasec/trivy").
-		WithEnvVariable("TRIVY_JAVA_DB_REPOSITORY", "public.ecr.aws/aquasecurity/trivy-java-db")
+// All the supported SBOM formats
+var supportedSbomFormats = []sbomFormat{
+	{name: "cyclonedx", report: "cyclonedx", fileName: "cyclonedx.json", predicateType: "cyclonedx"},
+	{name: "spdx", report: "spdx-json", fileName: "spdx.json", predicateType: "spdxjson"},
+}
 
-	trivy := dag.Trivy(dagger.TrivyOpts{
-		Container:          trivy_container,
-		DatabaseRepository: "public.ecr.aws/aquasecurity/trivy-db",
+// Returns the SBOM formats with the provided names without duplicates, CycloneDX if none is provided
+func newSbomFormats(
+	names []string,
+	// the SBOM is uploaded to deptrack, which only supports CycloneDX
+	deptrack bool,
+) ([]sbomFormat, error) {
+	if len(names) == 0 {
+		return supportedSbomFormats[:1], nil
+	}
+	var formats []sbomFormat
+	for _, name := range names {
+		i := findSbomFormat(supportedSbomFormats, strings.ToLower(name))
+		if i < 0 {
+			return nil, fmt.Errorf("unsupported SBOM format %q, expected \"cyclonedx\" or \"spdx\"", name)
+		}
+		// duplicates would create the same files and attestations twice
+		if findSbomFormat(formats, supportedSbomFormats[i].name) < 0 {
+			formats = append(formats, supportedSbomFormats[i])
+		}
+	}
+	if deptrack && findSbomFormat(formats, "cyclonedx") < 0 {
+		return nil, fmt.Errorf("the upload to deptrack requires the cyclonedx SBOM format, got %v", names)
+	}
+	return formats, nil
+}
+
+// Returns the index of the SBOM format with the provided name, -1 if there is none
+func findSbomFormat(formats []sbomFormat, name string) int {
+	return slices.IndexFunc(formats, func(format sbomFormat) bool {
+		return format.name == name
 	})
+}
 
-	return trivy.Container(container).
-		Report("cyclonedx").
-		WithName("cyclonedx.json")
+// A SBOM in a specific format
+type sbomFile struct {
+	format sbomFormat
+	file   *dagger.File
 }
 
-// Scans the SBOM for vulnerabilities
-func (m *PitcFlow) vulnscan(sbom *dagger.File) *dagger.File {
-	trivy_container := dag.Container().
-		From("aquasec/trivy").
+// Returns the SBOM in the provided format, nil if there is none
+func findSbom(sboms []sbomFile, format string) *dagger.File {
+	for _, sbom := range sboms {
+		if sbom.format.name == format {
+			return sbom.file
+		}
+	}
+	return nil
+}
+
+// Images of the tools used by the pipeline
+const (
+	trivyImage     = "aquasec/trivy"
+	cyclonedxImage = "cyclonedx/cyclonedx-cli"
+)
+
+// Repository of the Trivy vulnerability database
+const trivyDatabaseRepository = "public.ecr.aws/aquasecurity/trivy-db"
+
+// Returns the Trivy module using the public ECR databases
+func (m *PitcFlow) trivy() *dagger.Trivy {
+	trivy_container := toolContainer(trivyImage).
 		WithEnvVariable("TRIVY_JAVA_DB_REPOSITORY", "public.ecr.aws/aquasecurity/trivy-java-db")
 
-	trivy := dag.Trivy(dagger.TrivyOpts{
+	return dag.Trivy(dagger.TrivyOpts{
 		Container:          trivy_container,
-		DatabaseRepository: "public.ecr.aws/aquasecurity/trivy-db",
+		DatabaseRepository: trivyDatabaseRepository,
 	})
+}
+
+// Creates a SBOM in the provided format for the container
+func (m *PitcFlow) sbom(container *dagger.Container, format sbomFormat) *dagger.File {
+	return m.trivy().Container(container).
+		Report(format.report).
+		WithName(format.fileName)
+}
 
-	return trivy.Sbom(sbom).Report("json")
+// Creates a SBOM in the provided format for the sources in the directory e.g. go.mod, package-lock.json, pom.xml
+func (m *PitcFlow) sourceSbom(dir *dagger.Directory, format sbomFormat) *dagger.File {
+	return m.trivy().Filesystem(dir).
+		Report(format.report).
+		WithName(format.fileName)
 }
 
-// Publish cyclonedx SBOM to Deptrack
+// Merges the CycloneDX SBOMs into a single CycloneDX SBOM with the provided component as root of the hierarchy
+func (m *PitcFlow) mergeSboms(
+	// name of the root component
+	name string,
+	// version of the root component
+	version string,
+	// CycloneDX SBOMs to merge
+	sboms ...*dagger.File,
+) *dagger.File {
+	container := toolContainer(cyclonedxImage)
+	args := []string{"merge", "--hierarchical", "--name", name, "--version", version, "--input-format", "json", "--output-format", "json", "--output-file", "/tmp/merged.json", "--input-files"}
+	for i, sbom := range sboms {
+		path := fmt.Sprintf("/tmp/sbom-%d.json", i)
+		container = container.WithFile(path, sbom)
+		args = append(args, path)
+	}
+	return container.
+		WithExec(args, dagger.ContainerWithExecOpts{UseEntrypoint: true}).
+		File("/tmp/merged.json").
+		WithName("cyclonedx-merged.json")
+}
+
+// Creates the SBOMs of the source directory and merges the CycloneDX ones into the SBOMs of the image variants if requested
+func (m *PitcFlow) addSourceSboms(
+	dir *dagger.Directory,
+	formats []sbomFormat,
+	// merge the source and the image SBOMs
+	merge bool,
+	// registry address registry/repository/image:tag, names the root component of the merged SBOMs
+	registryAddress string,
+	variants []*imageVariant,
+) ([]sbomFile, error) {
+	var sources []sbomFile
+	for _, format := range formats {
+		sources = append(sources, sbomFile{format: format, file: m.sourceSbom(dir, format)})
+	}
+	if !merge {
+		return sources, nil
+	}
+	if variants[0].sbomOf("cyclonedx") == nil {
+		return nil, fmt.Errorf("merging the SBOMs requires the cyclonedx SBOM format")
+	}
+	name, version := splitImageAddress(registryAddress)
+	if name == "" {
+		name = "app"
+	}
+	for _, v := range variants {
+		v.mergedSbom = m.mergeSboms(name, version, v.sbomOf("cyclonedx"), findSbom(sources, "cyclonedx"))
+	}
+	return sources, nil
+}
+
+// Splits the image address registry/repository/image:tag into the name and the tag, the tag defaults to "latest"
+func splitImageAddress(address string) (string, string) {
+	name, _, _ := strings.Cut(address, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i], name[i+1:]
+	}
+	return name, "latest"
+}
+
+// Returns the registry host of the image address registry/repository/image:tag, Docker Hub if the address has none
+func registryHost(address string) string {
+	host, _, found := strings.Cut(address, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return "docker.io"
+	}
+	return host
+}
+
+// Scans the SBOM for vulnerabilities
+func (m *PitcFlow) vulnscan(sbom *dagger.File) *dagger.File {
+	return m.trivy().Sbom(sbom).Report("json")
+}
+
+// Publish cyclonedx SBOM to Deptrack and returns the response body containing the processing token
 func (m *PitcFlow) publishToDeptrack(
 	ctx context.Context,
 	// SBOM file
 	sbom *dagger.File,
-	// deptrack address for publishing the SBOM https://deptrack.example.com/api/v1/bom
+	// deptrack address https://deptrack.example.com or its BOM endpoint https://deptrack.example.com/api/v1/bom
 	address string,
 	// deptrack API key
 	apiKey *dagger.Secret,
-	// deptrack project UUID
-	projectUUID string,
+	// deptrack project
+	project deptrackProject,
+	// deptrack service bound to the host of the address
+	//+optional
+	service *dagger.Service,
 ) (string, error) {
-	return dag.Container().
-		From("curlimages/curl").
-		WithFile("sbom.json", sbom).
-		WithExec([]string{"curl", "-f", "-X", "POST", "-H", "'Content-Type: multipart/form-data'", "-H", fmt.Sprintf("'X-API-Key: %s'", apiKey), "-F", fmt.Sprintf("'project=%s'", projectUUID), "-F", "bom=@sbom.json", address}).
-		Stdout(ctx)
+	response, err := newDeptrack(address, apiKey, service).uploadBom(ctx, sbom, project)
+	if err != nil {
+		return "", err
+	}
+	return response.body, nil
 }
 
-// Publish the provided Container to the provided registry
+// Publish the provided Containers to the provided registry, multiple platform variants are published as one image index
 func (m *PitcFlow) publish(
 	ctx context.Context,
-	// Container to publish
-	container *dagger.Container,
+	// Containers to publish, one for each platform
+	containers []*dagger.Container,
 	// Registry address to publish to - formatted as [host]/[user]/[repo]:[tag]
 	registryAddress string,
 	// Username of the registry's account
@@ -126,15 +368,24 @@ func (m *PitcFlow) publish(
 	//+optional
 	registryPassword *dagger.Secret,
 ) (string, error) {
-	if registryUsername != "" && registryPassword != nil {
-		container = container.WithRegistryAuth(registryAddress, registryUsername, registryPassword)
+	container := containers[0]
+	var opts dagger.ContainerPublishOpts
+	if len(containers) > 1 {
+		container = dag.Container()
+		opts.PlatformVariants = containers
+	}
+	// anonymous and local registries are published to without credentials
+	if registryPassword != nil {
+		container = container.WithRegistryAuth(registryHost(registryAddress), registryUsername, registryPassword)
 	}
-	return container.Publish(ctx, registryAddress)
+	return container.Publish(ctx, registryAddress, opts)
 }
 
-// Sign the published image using cosign (keyless)
+// Sign the published image using cosign
 func (m *PitcFlow) sign(
 	ctx context.Context,
+	// signing configuration
+	signer *signer,
 	// Username of the registry's account
 	registryUsername string,
 	// API key, password or token to authenticate to the registry
@@ -142,12 +393,24 @@ func (m *PitcFlow) sign(
 	// Container image digest to sign
 	digest string,
 ) (string, error) {
-	return dag.Cosign().SignKeyless(ctx, digest, dagger.CosignSignKeylessOpts{RegistryUsername: registryUsername, RegistryPassword: registryPassword})
+	if signer.mode == signingKeyless {
+		return dag.Cosign().SignKeyless(ctx, digest, dagger.CosignSignKeylessOpts{RegistryUsername: registryUsername, RegistryPassword: registryPassword})
+	}
+	cosign, err := signer.cosign(digest, registryUsername, registryPassword)
+	if err != nil {
+		return "", err
+	}
+	// keys are used by air-gapped and on-prem setups, which cannot reach the public transparency log
+	return cosign.
+		WithExec([]string{"sign", "--yes", "--tlog-upload=false", "--key", signer.keyRef(), digest}, dagger.ContainerWithExecOpts{UseEntrypoint: true}).
+		Stdout(ctx)
 }
 
-// Attests the SBOM using cosign (keyless)
+// Attests the SBOM using cosign
 func (m *PitcFlow) attest(
 	ctx context.Context,
+	// signing configuration
+	signer *signer,
 	// Username of the registry's account
 	registryUsername string,
 	// API key, password or token to authenticate to the registry
@@ -159,10 +422,113 @@ func (m *PitcFlow) attest(
 	// SBOM type
 	sbomType string,
 ) (string, error) {
-	return dag.Cosign().AttestKeyless(ctx, digest, predicate, dagger.CosignAttestKeylessOpts{RegistryUsername: registryUsername, RegistryPassword: registryPassword, SbomType: sbomType})
+	if signer.mode == signingKeyless {
+		return dag.Cosign().AttestKeyless(ctx, digest, predicate, dagger.CosignAttestKeylessOpts{RegistryUsername: registryUsername, RegistryPassword: registryPassword, SbomType: sbomType})
+	}
+	cosign, err := signer.cosign(digest, registryUsername, registryPassword)
+	if err != nil {
+		return "", err
+	}
+	return cosign.
+		WithFile("/tmp/predicate.json", predicate).
+		WithExec([]string{"attest", "--yes", "--tlog-upload=false", "--key", signer.keyRef(), "--type", sbomType, "--predicate", "/tmp/predicate.json", digest}, dagger.ContainerWithExecOpts{UseEntrypoint: true}).
+		Stdout(ctx)
 }
 
-// Executes the common steps, does the error handling and returns a directory containing the results
+// Verifies the signature of the published image using cosign and returns the verification output
+func (m *PitcFlow) verifySignature(
+	ctx context.Context,
+	// signing configuration
+	signer *signer,
+	// registry of the image
+	registry registryTarget,
+	// Container image digest to verify
+	digest string,
+) (string, error) {
+	cosign, args, err := signer.verifier(registry)
+	if err != nil {
+		return "", err
+	}
+	return cosign.
+		WithExec(append(append([]string{"verify"}, args...), digest), dagger.ContainerWithExecOpts{UseEntrypoint: true}).
+		Stdout(ctx)
+}
+
+// Verifies the attestations of the published image with the predicate type using cosign and returns the verification output
+func (m *PitcFlow) verifyAttestation(
+	ctx context.Context,
+	// signing configuration
+	signer *signer,
+	// registry of the image
+	registry registryTarget,
+	// Container image digest to verify
+	digest string,
+	// predicate type of the attestations e.g. "cyclonedx"
+	predicateType string,
+) (string, error) {
+	cosign, args, err := signer.verifier(registry)
+	if err != nil {
+		return "", err
+	}
+	return cosign.
+		WithExec(append(append([]string{"verify-attestation", "--type", predicateType}, args...), digest), dagger.ContainerWithExecOpts{UseEntrypoint: true}).
+		Stdout(ctx)
+}
+
+// Verifies the attestations of all the image references with the predicate type and returns their joined verification outputs
+func (m *PitcFlow) verifyAttestations(
+	ctx context.Context,
+	// signing configuration
+	signer *signer,
+	// registry of the images
+	registry registryTarget,
+	// Container image digests to verify
+	references []string,
+	// predicate type of the attestations e.g. "cyclonedx"
+	predicateType string,
+) (string, error) {
+	var outputs strings.Builder
+	for _, reference := range references {
+		output, err := m.verifyAttestation(ctx, signer, registry, reference, predicateType)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", reference, err)
+		}
+		outputs.WriteString(output)
+	}
+	return outputs.String(), nil
+}
+
+// Returns if the attestations of the predicate type are bound to the image manifest of each platform instead of the image (index),
+// the SBOMs and vulnerability reports of the platforms differ
+func platformAttestation(predicateType string) bool {
+	return predicateType == vulnPredicateType || slices.ContainsFunc(supportedSbomFormats, func(format sbomFormat) bool {
+		return format.predicateType == predicateType
+	})
+}
+
+// Returns the references of the image manifests of the platforms, the image itself if it is no image index
+func platformReferences(name string, reference string, platforms []platformDigest) []string {
+	if len(platforms) == 0 {
+		return []string{reference}
+	}
+	references := make([]string, 0, len(platforms))
+	for _, platform := range platforms {
+		references = append(references, name+"@"+platform.Digest)
+	}
+	return references
+}
+
+// Returns the reference of the variant's image manifest within the published image
+func variantReference(name string, v *imageVariant, platforms []platformDigest) (string, error) {
+	for _, platform := range platforms {
+		if v.platform == "" || string(v.platform) == platform.Platform {
+			return name + "@" + platform.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("the published image has no manifest for the platform %s", v.platform)
+}
+
+// Executes the common steps, does the error handling and returns the results of the pipeline run
 func (m *PitcFlow) common(
 	ctx context.Context,
 	doLint bool,
@@ -177,7 +543,10 @@ func (m *PitcFlow) common(
 	testReports *dagger.Directory,
 	//+optional
 	integrationTestReports *dagger.Directory,
-	vulnerabilityScan *dagger.File,
+	// SBOMs of the source directory, empty if not created
+	sourceSboms []sbomFile,
+	// vulnerability gate, nil if disabled
+	gate *vulnerabilityGate,
 	// registry username for publishing the container image
 	//+optional
 	registryUsername string,
@@ -187,130 +556,564 @@ func (m *PitcFlow) common(
 	// registry address registry/repository/image:tag
 	//+optional
 	registryAddress string,
-	// deptrack address for publishing the SBOM https://deptrack.example.com/api/v1/bom
+	// docker config.json with the credentials of the registry and the mirrors, used if they have no password
 	//+optional
-	dtAddress string,
-	// deptrack project UUID
+	registryConfig *dagger.Secret,
+	// protection of the published tags against being overwritten, nil if disabled
+	protection *tagProtection,
+	// quarantine the image is published to until it passed all the steps, nil if published to the registry address directly
+	quarantine *quarantine,
+	// deptrack address https://deptrack.example.com or its BOM endpoint https://deptrack.example.com/api/v1/bom
 	//+optional
-	dtProjectUUID string,
+	dtAddress string,
 	// deptrack API key
 	//+optional
 	dtApiKey *dagger.Secret,
-	// app container
-	image *dagger.Container,
-) (*dagger.Directory, error) {
-	var err error
-	// Get the names of the directories to fail on errors of the functions
-	if doLint {
-		_, err = lintReports.Name(ctx)
-		if err != nil {
-			return nil, err
+	// deptrack project the SBOM is uploaded to
+	dtProject deptrackProject,
+	// deptrack service bound to the host of the deptrack address
+	//+optional
+	dtService *dagger.Service,
+	// deptrack gate, nil if deptrack is not waited for
+	dtGate *deptrackGate,
+	// record a failed upload to deptrack as soft failure
+	dtAllowFailure bool,
+	// signing configuration for image signatures and attestations
+	signer *signer,
+	// build of the app container described by the SLSA provenance, nil if the container was not built
+	provenance *buildProvenance,
+	// attest the lint, SAST and test reports to the published image
+	attestReports bool,
+	// additional tags of the published image
+	tags []string,
+	// source directory the additional tags are derived from by its git metadata, nil if not derived
+	gitSource *dagger.Directory,
+	// registries the published image is copied to with its signatures and attestations
+	mirrors []registryTarget,
+	// app container variants, one for each platform
+	variants []*imageVariant,
+	// return the results of a run with failed steps instead of failing
+	allowFailure bool,
+) (*PipelineResult, error) {
+	// Evaluate all the independent steps concurrently and collect their outcomes
+	outcomes := runSteps(ctx,
+		step{name: "lint", skip: !doLint, run: func(ctx context.Context) error {
+			_, err := lintReports.Sync(ctx)
+			return err
+		}},
+		step{name: "sast", skip: !doSast, run: func(ctx context.Context) error {
+			_, err := securityReports.Sync(ctx)
+			return err
+		}},
+		step{name: "unit-tests", skip: !doTest, run: func(ctx context.Context) error {
+			_, err := testReports.Sync(ctx)
+			return err
+		}},
+		step{name: "integration-tests", skip: !doIntTest, run: func(ctx context.Context) error {
+			_, err := integrationTestReports.Sync(ctx)
+			return err
+		}},
+		step{name: "build", run: func(ctx context.Context) error {
+			return runAll(ctx, variants, func(ctx context.Context, v *imageVariant) error {
+				_, err := v.container.Sync(ctx)
+				return variantError(v, err)
+			})
+		}},
+		step{name: "sbom", run: func(ctx context.Context) error {
+			return runAll(ctx, variants, func(ctx context.Context, v *imageVariant) error {
+				return variantError(v, runAll(ctx, v.sboms, func(ctx context.Context, sbom sbomFile) error {
+					_, err := sbom.file.Sync(ctx)
+					return err
+				}))
+			})
+		}},
+		step{name: "source-sbom", skip: len(sourceSboms) == 0, run: func(ctx context.Context) error {
+			err := runAll(ctx, sourceSboms, func(ctx context.Context, sbom sbomFile) error {
+				_, err := sbom.file.Sync(ctx)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			return runAll(ctx, variants, func(ctx context.Context, v *imageVariant) error {
+				if v.mergedSbom == nil {
+					return nil
+				}
+				_, err := v.mergedSbom.Sync(ctx)
+				return variantError(v, err)
+			})
+		}},
+		step{name: "vulnscan", run: func(ctx context.Context) error {
+			return runAll(ctx, variants, func(ctx context.Context, v *imageVariant) error {
+				_, err := v.vulnerabilityScan.Sync(ctx)
+				return variantError(v, err)
+			})
+		}},
+	)
+
+	// Evaluate the vulnerability reports before anything gets published
+	outcomes = append(outcomes, runSteps(ctx,
+		step{name: "vuln-gate", skip: gate == nil || !passed(outcomes, "vulnscan"), run: func(ctx context.Context) error {
+			var errs []error
+			for _, v := range variants {
+				errs = append(errs, variantError(v, m.vulnGate(ctx, v.vulnerabilityScan, gate)))
+			}
+			return errors.Join(errs...)
+		}},
+	)...)
+
+	// Upload the SBOM to deptrack and wait for its analysis before anything gets published
+	hasSbom := passed(outcomes, "sbom")
+	// deptrack only supports CycloneDX SBOMs, the merged SBOM is preferred as it is the most complete
+	dtSbom := variants[0].sbomOf("cyclonedx")
+	if variants[0].mergedSbom != nil && passed(outcomes, "source-sbom") {
+		dtSbom = variants[0].mergedSbom
+	}
+	dtResponse := ""
+	doDeptrack := hasSbom && dtSbom != nil && dtAddress != "" && dtProject.isSet() && dtApiKey != nil
+	outcomes = append(outcomes, runSteps(ctx,
+		// a failed upload only soft fails if allowed and the deptrack gate does not depend on it,
+		// only the SBOM of the first platform variant is uploaded as the project holds one SBOM
+		step{name: "deptrack", skip: !doDeptrack, soft: dtAllowFailure && dtGate == nil, run: func(ctx context.Context) error {
+			var err error
+			dtResponse, err = m.publishToDeptrack(ctx, dtSbom, dtAddress, dtApiKey, dtProject, dtService)
+			return err
+		}},
+	)...)
+	dtFindings := ""
+	dtViolations := ""
+	outcomes = append(outcomes, runSteps(ctx,
+		step{name: "deptrack-gate", skip: dtGate == nil || !passed(outcomes, "deptrack"), run: func(ctx context.Context) error {
+			var err error
+			dtFindings, dtViolations, err = m.deptrackGate(ctx, newDeptrack(dtAddress, dtApiKey, dtService), dtProject, dtResponse, dtGate)
+			return err
+		}},
+	)...)
+
+	// Only publish once linting, scanning, testing, building and the gates succeeded,
+	// a quarantined image is published once built and only released if all the steps succeeded
+	digest := ""
+	var publishedTags []string
+	var platformDigests []platformDigest
+	// the steps before publishing decide if the image may be signed and attested at all
+	prePublishPassed := stepsError(outcomes) == nil
+	doPublish := prePublishPassed && registryAddress != ""
+	publishAddress := registryAddress
+	if quarantine != nil {
+		doPublish = passed(outcomes, "build") && registryAddress != ""
+		publishAddress = quarantine.address(registryAddress)
+	}
+	containers := make([]*dagger.Container, 0, len(variants))
+	for _, v := range variants {
+		containers = append(containers, v.container)
+	}
+	outcomes = append(outcomes, runSteps(ctx,
+		step{name: "publish", skip: !doPublish, run: func(ctx context.Context) error {
+			// the resolved credentials are used by all the following steps
+			registry, err := withDockerConfig(ctx, registryTarget{address: registryAddress, username: registryUsername, password: registryPassword}, registryConfig)
+			if err != nil {
+				return err
+			}
+			registryUsername, registryPassword = registry.username, registry.password
+			publishedTags = tags
+			if gitSource != nil {
+				derived, floating, err := m.gitTags(ctx, gitSource)
+				if err != nil {
+					return err
+				}
+				publishedTags = append(slices.Clone(tags), derived...)
+				// the floating tags of a release are expected to point to each new release
+				if protection != nil {
+					protection = protection.allowing(floating)
+				}
+			}
+			publishedTags = additionalTags(registryAddress, publishedTags)
+			// the tags of a quarantined image are added and checked when it is released
+			if quarantine == nil && protection != nil {
+				err = m.checkTags(ctx, protection, registry, publishedTags, func(ctx context.Context) (string, error) {
+					return m.localDigest(ctx, containers)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			digest, err = m.publish(ctx, containers, publishAddress, registryUsername, registryPassword)
+			if err != nil {
+				return err
+			}
+			// the additional tags point to the published digest, which is signed only once
+			if quarantine == nil {
+				name, _ := splitImageAddress(publishAddress)
+				err = m.tagImage(ctx, registryTarget{address: publishAddress, username: registryUsername, password: registryPassword}, name+"@"+referenceDigest(digest), publishedTags)
+				if err != nil {
+					return err
+				}
+			}
+			// the platform digests of a single platform image are the digest of the image itself
+			if len(variants) > 1 {
+				platformDigests, err = m.platformDigests(ctx, registryTarget{address: publishAddress, username: registryUsername, password: registryPassword}, digest)
+				return err
+			}
+			platform, err := variants[0].container.Platform(ctx)
+			platformDigests = []platformDigest{{Platform: string(platform), Digest: referenceDigest(digest)}}
+			return err
+		}},
+	)...)
+
+	// After publishing the image, we are ready to sign and attest,
+	// a quarantined image which failed the steps before publishing is never signed so it cannot pass as trusted
+	published := passed(outcomes, "publish")
+	doSign := published && prePublishPassed
+	provenancePredicate := ""
+	reportDirs := map[string]*dagger.Directory{
+		"lint":              lintReports,
+		"sast":              securityReports,
+		"unit-tests":        testReports,
+		"integration-tests": integrationTestReports,
+	}
+	var attestedReports []string
+	for _, name := range slices.Sorted(maps.Keys(reportDirs)) {
+		if passed(outcomes, name) {
+			attestedReports = append(attestedReports, name)
 		}
 	}
-	if doTest {
-		_, err = testReports.Name(ctx)
-		if err != nil {
-			return nil, err
+	// the provenance only lists the tools which ran up to the publishing, not the ones signing and attesting concurrently
+	tools := usedToolContainers()
+	// cosign appends each attestation to the attestations image of the digest, concurrent writes would overwrite each other
+	var attestMu sync.Mutex
+	attest := func(ctx context.Context, reference string, predicate *dagger.File, predicateType string) error {
+		attestMu.Lock()
+		defer attestMu.Unlock()
+		_, err := m.attest(ctx, signer, registryUsername, registryPassword, reference, predicate, predicateType)
+		return err
+	}
+	publishedName, _ := splitImageAddress(publishAddress)
+	outcomes = append(outcomes, runSteps(ctx,
+		step{name: "sign", skip: !doSign, run: func(ctx context.Context) error {
+			_, err := m.sign(ctx, signer, registryUsername, registryPassword, digest)
+			return err
+		}},
+		// the SBOMs of each platform variant are attested to the image manifest of its platform
+		step{name: "attest", skip: !doSign || !hasSbom, run: func(ctx context.Context) error {
+			return runAll(ctx, variants, func(ctx context.Context, v *imageVariant) error {
+				reference, err := variantReference(publishedName, v, platformDigests)
+				if err != nil {
+					return variantError(v, err)
+				}
+				return variantError(v, runAll(ctx, v.sboms, func(ctx context.Context, sbom sbomFile) error {
+					return attest(ctx, reference, sbom.file, sbom.format.predicateType)
+				}))
+			})
+		}},
+		// the scan reports of all the platform variants are attested like the SBOMs
+		step{name: "attest-vuln", skip: !doSign || !passed(outcomes, "vulnscan"), run: func(ctx context.Context) error {
+			scan := outcomeOf(outcomes, "vulnscan")
+			return runAll(ctx, variants, func(ctx context.Context, v *imageVariant) error {
+				reference, err := variantReference(publishedName, v, platformDigests)
+				if err != nil {
+					return variantError(v, err)
+				}
+				predicate, err := m.vulnPredicate(ctx, v.vulnerabilityScan, scan.startedAt, scan.startedAt.Add(scan.duration))
+				if err == nil {
+					err = attest(ctx, reference, predicate, vulnPredicateType)
+				}
+				return variantError(v, err)
+			})
+		}},
+		// each report directory is bound to the image with the predicate type of its step
+		step{name: "attest-reports", skip: !doSign || !attestReports || len(attestedReports) == 0, run: func(ctx context.Context) error {
+			return runAll(ctx, attestedReports, func(ctx context.Context, name string) error {
+				predicate, err := m.reportPredicate(ctx, name, reportDirs[name])
+				if err == nil {
+					err = attest(ctx, digest, predicate, reportPredicateTypes[name])
+				}
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				return nil
+			})
+		}},
+		// the provenance describes the build of all the platform variants
+		step{name: "provenance", skip: !doSign || provenance == nil || !passed(outcomes, "build"), run: func(ctx context.Context) error {
+			build := outcomeOf(outcomes, "build")
+			var err error
+			provenancePredicate, err = m.provenance(ctx, provenance, tools, build.startedAt, build.startedAt.Add(build.duration))
+			if err != nil {
+				return err
+			}
+			predicate := dag.Directory().WithNewFile("slsa-provenance.json", provenancePredicate).File("slsa-provenance.json")
+			return attest(ctx, digest, predicate, provenancePredicateType)
+		}},
+	)...)
+
+	// Verify the signature and attestations to have evidence that the published image can be trusted
+	verifications := map[string]string{}
+	var verificationsMu sync.Mutex
+	outcomes = append(outcomes, runSteps(ctx,
+		step{name: "verify", skip: !passed(outcomes, "sign"), run: func(ctx context.Context) error {
+			registry := registryTarget{address: publishAddress, username: registryUsername, password: registryPassword}
+			output, err := m.verifySignature(ctx, signer, registry, digest)
+			if err != nil {
+				return fmt.Errorf("failed to verify the signature: %w", err)
+			}
+			verifications["verify/signature.json"] = output
+			// the predicate types are keyed by the name used for the verification output,
+			// the attestations of the platform variants are verified on the manifest of each platform
+			predicateTypes := map[string]string{}
+			if passed(outcomes, "attest") {
+				for _, sbom := range variants[0].sboms {
+					predicateTypes[sbom.format.predicateType] = sbom.format.predicateType
+				}
+			}
+			if passed(outcomes, "attest-vuln") {
+				predicateTypes[vulnPredicateType] = vulnPredicateType
+			}
+			if passed(outcomes, "provenance") {
+				predicateTypes[provenancePredicateType] = provenancePredicateType
+			}
+			if passed(outcomes, "attest-reports") {
+				for _, name := range attestedReports {
+					predicateTypes[name] = reportPredicateTypes[name]
+				}
+			}
+			references := platformReferences(publishedName, digest, platformDigests)
+			return runAll(ctx, slices.Sorted(maps.Keys(predicateTypes)), func(ctx context.Context, name string) error {
+				attested := []string{digest}
+				if platformAttestation(predicateTypes[name]) {
+					attested = references
+				}
+				output, err := m.verifyAttestations(ctx, signer, registry, attested, predicateTypes[name])
+				if err != nil {
+					return fmt.Errorf("failed to verify the %s attestation: %w", name, err)
+				}
+				verificationsMu.Lock()
+				defer verificationsMu.Unlock()
+				verifications[fmt.Sprintf("verify/attestation-%s.json", name)] = output
+				return nil
+			})
+		}},
+	)...)
+
+	// Release the quarantined image with its signatures and attestations once all the steps succeeded, reject it otherwise
+	quarantined := digest
+	rejected := ""
+	if quarantine != nil && published {
+		outcomes = append(outcomes, runSteps(ctx,
+			step{name: "release", skip: stepsError(outcomes) != nil, run: func(ctx context.Context) error {
+				source := registryTarget{address: publishAddress, username: registryUsername, password: registryPassword}
+				target := registryTarget{address: registryAddress, username: registryUsername, password: registryPassword}
+				if protection != nil {
+					err := m.checkTags(ctx, protection, target, publishedTags, publishedDigest(quarantined))
+					if err != nil {
+						return err
+					}
+				}
+				released, err := m.release(ctx, source, digest, target, publishedTags)
+				if err != nil {
+					return err
+				}
+				digest = released
+				return nil
+			}},
+		)...)
+		// the rejected image is kept in the quarantine for its analysis, also if its release failed
+		outcomes = append(outcomes, runSteps(ctx,
+			step{name: "reject", skip: passed(outcomes, "release"), soft: true, run: func(ctx context.Context) error {
+				name, _ := splitImageAddress(publishAddress)
+				tag := quarantine.rejectedTag(registryAddress)
+				rejected = name + ":" + tag
+				return m.tagImage(ctx, registryTarget{address: publishAddress, username: registryUsername, password: registryPassword}, quarantined, []string{tag})
+			}},
+		)...)
+		published = passed(outcomes, "release")
+	}
+
+	// Replicate the image with its signatures and attestations to the mirrors once it has been verified
+	var mirrored []string
+	var mirroredMu sync.Mutex
+	outcomes = append(outcomes, runSteps(ctx,
+		step{name: "mirror", skip: !published || len(mirrors) == 0 || stepsError(outcomes) != nil, run: func(ctx context.Context) error {
+			source := registryTarget{address: registryAddress, username: registryUsername, password: registryPassword}
+			return runAll(ctx, mirrors, func(ctx context.Context, mirror registryTarget) error {
+				mirror, err := withDockerConfig(ctx, mirror, registryConfig)
+				if err != nil {
+					return err
+				}
+				// the copy is forced, so the tag of the mirror is protected like the published ones
+				if protection != nil {
+					err = m.checkTags(ctx, protection, mirror, nil, publishedDigest(digest))
+					if err != nil {
+						return err
+					}
+				}
+				ref, err := m.mirror(ctx, source, digest, mirror)
+				if err != nil {
+					return err
+				}
+				mirroredMu.Lock()
+				defer mirroredMu.Unlock()
+				mirrored = append(mirrored, ref)
+				return nil
+			})
+		}},
+	)...)
+	slices.Sort(mirrored)
+
+	// Only add the results of the successful steps, the others cannot be evaluated
+	artifacts := map[string][]string{}
+	reports := dag.Directory()
+	if passed(outcomes, "lint") {
+		reports = reports.WithDirectory("lint", lintReports)
+		artifacts["lint"] = []string{"lint/"}
+	}
+	if passed(outcomes, "sast") {
+		reports = reports.WithDirectory("scan", securityReports)
+		artifacts["sast"] = []string{"scan/"}
+	}
+	if passed(outcomes, "unit-tests") {
+		reports = reports.WithDirectory("unit-tests", testReports)
+		artifacts["unit-tests"] = []string{"unit-tests/"}
+	}
+	if passed(outcomes, "integration-tests") {
+		reports = reports.WithDirectory("integration-tests", integrationTestReports)
+		artifacts["integration-tests"] = []string{"integration-tests/"}
+	}
+
+	result := &PipelineResult{
+		Reports: reports,
+	}
+	if quarantine != nil {
+		result.QuarantineRef = quarantined
+		if quarantined != "" {
+			artifacts["publish"] = []string{quarantined}
+		}
+		if passed(outcomes, "reject") {
+			artifacts["reject"] = []string{rejected}
 		}
 	}
-	if doIntTest {
-		_, err = integrationTestReports.Name(ctx)
-		if err != nil {
-			return nil, err
+	directory := reports
+	for _, v := range variants {
+		variant := &ImageVariant{Platform: string(v.platform)}
+		if passed(outcomes, "vulnscan") {
+			vulnerabilityScanName, err := v.vulnerabilityScan.Name(ctx)
+			if err != nil {
+				return nil, err
+			}
+			path := fmt.Sprintf("vuln/%s%s", v.resultsDir(), vulnerabilityScanName)
+			variant.VulnReport = v.vulnerabilityScan
+			directory = directory.WithFile(path, v.vulnerabilityScan)
+			artifacts["vulnscan"] = append(artifacts["vulnscan"], path)
+		}
+		if hasSbom {
+			for _, sbom := range v.sboms {
+				path := fmt.Sprintf("sbom/%s%s", v.resultsDir(), sbom.format.fileName)
+				variant.Sboms = append(variant.Sboms, sbom.file)
+				directory = directory.WithFile(path, sbom.file)
+				artifacts["sbom"] = append(artifacts["sbom"], path)
+			}
+			variant.Sbom = v.sboms[0].file
+		}
+		if v.mergedSbom != nil && passed(outcomes, "source-sbom") {
+			path := fmt.Sprintf("sbom/%scyclonedx-merged.json", v.resultsDir())
+			variant.MergedSbom = v.mergedSbom
+			directory = directory.WithFile(path, v.mergedSbom)
+			artifacts["source-sbom"] = append(artifacts["source-sbom"], path)
 		}
+		result.Variants = append(result.Variants, variant)
 	}
-	if doSast {
-		_, err = securityReports.Name(ctx)
-		if err != nil {
-			return nil, err
+	if passed(outcomes, "source-sbom") {
+		for _, sbom := range sourceSboms {
+			path := fmt.Sprintf("sbom/source/%s", sbom.format.fileName)
+			result.SourceSboms = append(result.SourceSboms, sbom.file)
+			directory = directory.WithFile(path, sbom.file)
+			artifacts["source-sbom"] = append(artifacts["source-sbom"], path)
 		}
 	}
-	vulnerabilityScanName, err := vulnerabilityScan.Name(ctx)
-	if err != nil {
-		return nil, err
+	result.VulnReport = result.Variants[0].VulnReport
+	result.Sbom = result.Variants[0].Sbom
+	if len(mirrored) > 0 {
+		result.Mirrors = mirrored
+		artifacts["mirror"] = mirrored
 	}
-
-	var sbom *dagger.File
-	digest := ""
-	var wg sync.WaitGroup
-	// After linting, scanning and testing is done, we are ready to create the sbom and publish the image
-	if registryAddress != "" && registryUsername != "" && registryPassword != nil {
-		wg.Add(2)
-		sbom = func() *dagger.File {
-			defer wg.Done()
-			return m.sbom(image)
-		}()
-		digest, err = func() (string, error) {
-			defer wg.Done()
-			return m.publish(ctx, image, registryAddress, registryUsername, registryPassword)
-		}()
-		// This Blocks the execution until its counter become 0
-		wg.Wait()
-	}
-
-	// After publishing the image, we are ready to sign and attest and publish to deptrack
-	if err == nil && (digest != "" || sbom != nil) {
-		var dtErr error
-		var signErr error
-		var attErr error
-		if sbom != nil && dtAddress != "" && dtProjectUUID != "" && dtApiKey != nil {
-			wg.Add(1)
-			_, dtErr = func() (string, error) {
-				defer wg.Done()
-				return m.publishToDeptrack(ctx, sbom, dtAddress, dtApiKey, dtProjectUUID)
-			}()
+	// the published image is pinned by its digest for the deployment, a quarantined image once it was released
+	if published {
+		name, tag := splitImageAddress(registryAddress)
+		result.ImageDigest = referenceDigest(digest)
+		result.ImageRef = name + "@" + result.ImageDigest
+		result.Tags = append([]string{tag}, publishedTags...)
+		var tagRefs strings.Builder
+		for _, tag := range result.Tags {
+			tagRefs.WriteString(name + ":" + tag + "\n")
 		}
-		if digest != "" && registryUsername != "" && registryPassword != nil {
-			wg.Add(1)
-			_, signErr = func() (string, error) {
-				defer wg.Done()
-				return m.sign(ctx, registryUsername, registryPassword, digest)
-			}()
-			if sbom != nil {
-				wg.Add(1)
-				_, attErr = func() (string, error) {
-					defer wg.Done()
-					return m.attest(ctx, registryUsername, registryPassword, digest, sbom, "cyclonedx")
-				}()
+		for _, variant := range result.Variants {
+			for _, platformDigest := range platformDigests {
+				if variant.Platform == "" || variant.Platform == platformDigest.Platform {
+					variant.Digest = platformDigest.Digest
+				}
 			}
 		}
-		// This Blocks the execution until its counter become 0
-		wg.Wait()
-
-		if dtErr != nil || signErr != nil || attErr != nil {
-			err = fmt.Errorf("one or more errors occurred: dtErr=%w, signErr=%w, attErr=%w", dtErr, signErr, attErr)
+		lock, err := imageLockJSON(name, result.ImageDigest, result.Tags, platformDigests, mirrored)
+		if err != nil {
+			return nil, err
+		}
+		directory = directory.
+			WithNewFile("image/reference", result.ImageRef+"\n").
+			WithNewFile("image/tags", tagRefs.String()).
+			WithNewFile("image/image.lock", lock)
+		// the released image is the artifact of the release step, the quarantined image the one of the publish step
+		delivery := "publish"
+		if quarantine != nil {
+			delivery = "release"
+		}
+		artifacts[delivery] = []string{digest, "image/reference", "image/tags", "image/image.lock"}
+		for _, tag := range publishedTags {
+			artifacts[delivery] = append(artifacts[delivery], name+":"+tag)
 		}
 	}
-
-	sbomName := ""
-	if sbom != nil {
-		sbomName, err = sbom.Name(ctx)
+	if passed(outcomes, "deptrack") {
+		directory = directory.WithNewFile("deptrack/bom-upload.json", dtResponse)
+		artifacts["deptrack"] = []string{"deptrack/bom-upload.json"}
 	}
-
-	errorString := ""
-	if err != nil {
-		errorString = err.Error()
+	if provenancePredicate != "" {
+		directory = directory.WithNewFile("provenance/slsa-provenance.json", provenancePredicate)
+		artifacts["provenance"] = []string{"provenance/slsa-provenance.json"}
 	}
-
-	result_container := dag.Container().WithWorkdir("/tmp/out")
-	if doLint {
-		result_container = result_container.WithDirectory("/tmp/out/lint/", lintReports)
+	// the verification outputs are added even if a later verification failed
+	for _, path := range slices.Sorted(maps.Keys(verifications)) {
+		directory = directory.WithNewFile(path, verifications[path])
+		artifacts["verify"] = append(artifacts["verify"], path)
 	}
-	if doSast {
-		result_container = result_container.WithDirectory("/tmp/out/scan/", securityReports)
+	// the findings and violations are added even if the gate failed
+	if dtFindings != "" {
+		directory = directory.WithNewFile("deptrack/findings.json", dtFindings)
+		artifacts["deptrack-gate"] = append(artifacts["deptrack-gate"], "deptrack/findings.json")
 	}
-	if doTest {
-		result_container = result_container.WithDirectory("/tmp/out/unit-tests/", testReports)
+	if dtViolations != "" {
+		directory = directory.WithNewFile("deptrack/violations.json", dtViolations)
+		artifacts["deptrack-gate"] = append(artifacts["deptrack-gate"], "deptrack/violations.json")
 	}
-	if doIntTest {
-		result_container = result_container.WithDirectory("/tmp/out/integration-tests/", integrationTestReports)
+
+	result.Steps = stepResults(outcomes, artifacts)
+	status, err := statusJSON(result.Steps)
+	if err != nil {
+		return nil, err
 	}
-	if sbom != nil {
-		result_container = result_container.WithFile(fmt.Sprintf("/tmp/out/sbom/%s", sbomName), sbom)
+	result.Directory = directory.WithNewFile("status.json", status)
+	result.Status = result.Directory.File("status.json")
+
+	// the call fails like a single failed step would, soft failures are only recorded
+	if !allowFailure {
+		if err := stepsError(outcomes); err != nil {
+			return nil, err
+		}
 	}
+	return result, nil
+}
 
-	return result_container.
-		WithFile(fmt.Sprintf("/tmp/out/vuln/%s", vulnerabilityScanName), vulnerabilityScan).
-		WithNewFile("/tmp/out/status.txt", errorString).
-		Directory("."), err
+// Adds the platform of the variant to the error, if the image has multiple platforms
+func variantError(v *imageVariant, err error) error {
+	if err == nil || v.platform == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %w", v.platform, err)
 }
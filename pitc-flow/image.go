@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Format version of the image.lock file
+const imageLockVersion = 1
+
+// Content of the image.lock file pinning the published image
+type imageLock struct {
+	Version   int              `json:"version"`
+	Name      string           `json:"name"`
+	Digest    string           `json:"digest"`
+	Reference string           `json:"reference"`
+	Tags      []string         `json:"tags"`
+	Platforms []platformDigest `json:"platforms"`
+	Mirrors   []string         `json:"mirrors,omitempty"`
+}
+
+// Digest of a platform variant of the published image
+type platformDigest struct {
+	// platform e.g. "linux/arm64"
+	Platform string `json:"platform"`
+	// digest of the platform's image manifest
+	Digest string `json:"digest"`
+}
+
+// Returns the digests of the platform variants of the published image index
+func (m *PitcFlow) platformDigests(
+	ctx context.Context,
+	// registry of the image
+	registry registryTarget,
+	// image reference with digest
+	reference string,
+) ([]platformDigest, error) {
+	args := []string{"manifest"}
+	if registry.service != nil {
+		args = append(args, "--insecure")
+	}
+	manifest, err := craneContainer(registry).
+		WithExec(append(args, reference), dagger.ContainerWithExecOpts{UseEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the manifest of %s: %w", reference, err)
+	}
+	var index struct {
+		Manifests []struct {
+			Digest   string `json:"digest"`
+			Platform struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+				Variant      string `json:"variant"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal([]byte(manifest), &index); err != nil {
+		return nil, fmt.Errorf("failed to parse the manifest of %s: %w", reference, err)
+	}
+	var digests []platformDigest
+	for _, manifest := range index.Manifests {
+		platform := manifest.Platform.OS + "/" + manifest.Platform.Architecture
+		if manifest.Platform.Variant != "" {
+			platform += "/" + manifest.Platform.Variant
+		}
+		digests = append(digests, platformDigest{Platform: platform, Digest: manifest.Digest})
+	}
+	return digests, nil
+}
+
+// Creates the content of the image.lock file
+func imageLockJSON(name string, digest string, tags []string, platforms []platformDigest, mirrors []string) (string, error) {
+	references := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		references = append(references, name+":"+tag)
+	}
+	content, err := json.MarshalIndent(imageLock{
+		Version:   imageLockVersion,
+		Name:      name,
+		Digest:    digest,
+		Reference: name + "@" + digest,
+		Tags:      references,
+		Platforms: platforms,
+		Mirrors:   mirrors,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// Returns the digest of the image reference e.g. "sha256:abc", empty if the reference has none
+func referenceDigest(reference string) string {
+	_, digest, _ := strings.Cut(reference, "@")
+	return digest
+}
@@ -10,13 +10,14 @@ package main
 import (
 	"context"
 	"dagger/pitc-flow/internal/dagger"
+	"encoding/json"
 	"fmt"
-	"sync"
+	"strings"
 )
 
 type PitcFlow struct{}
 
-// Executes only the desired steps and returns a directory with the results
+// Executes only the desired steps and returns the results, fails if a step failed unless failures are allowed
 func (m *PitcFlow) Flex(
 	ctx context.Context,
 	// source directory
@@ -54,7 +55,7 @@ func (m *PitcFlow) Flex(
 	// registry address registry/repository/image:tag
 	//+optional
 	registryAddress string,
-	// deptrack address for publishing the SBOM https://deptrack.example.com/api/v1/bom
+	// deptrack address https://deptrack.example.com or its BOM endpoint https://deptrack.example.com/api/v1/bom
 	//+optional
 	dtAddress string,
 	// deptrack project UUID
@@ -63,67 +64,223 @@ func (m *PitcFlow) Flex(
 	// deptrack API key
 	//+optional
 	dtApiKey *dagger.Secret,
+	// deptrack project name, used instead of the project UUID
+	//+optional
+	dtProjectName string,
+	// deptrack project version, defaults to the tag of the registry address, required with the project name if the image is not published
+	//+optional
+	dtProjectVersion string,
+	// deptrack parent project UUID or name
+	//+optional
+	dtParentProject string,
+	// deptrack project tags
+	//+optional
+	dtProjectTags []string,
+	// create the deptrack project (version) if it does not exist yet
+	//+optional
+	dtAutoCreate bool,
+	// deptrack service bound to the host of the deptrack address e.g. a local instance
+	//+optional
+	dtService *dagger.Service,
+	// wait until deptrack analysed the SBOM and fetch the findings and policy violations
+	//+optional
+	dtWait bool,
+	// maximum time in seconds to wait for the deptrack analysis (default 300)
+	//+optional
+	dtWaitTimeout int,
+	// minimum severity of deptrack findings which blocks publishing e.g. "HIGH"
+	//+optional
+	dtFailSeverity string,
+	// minimum deptrack policy violation state which blocks publishing: "INFO", "WARN" or "FAIL"
+	//+optional
+	dtFailViolationState string,
+	// record a failed upload to deptrack without failing the pipeline, unless the deptrack gate depends on it
+	//+optional
+	dtAllowFailure bool,
+	// signing mode for image signatures and attestations: "keyless", "key" or "kms" (default "keyless")
+	//+optional
+	signingMode string,
+	// cosign private key for the signing mode "key"
+	//+optional
+	cosignKey *dagger.Secret,
+	// password of the cosign private key
+	//+optional
+	cosignPassword *dagger.Secret,
+	// KMS key URI for the signing mode "kms" e.g. "hashivault://cosign"
+	//+optional
+	kmsKey string,
+	// Hashicorp Vault address for "hashivault://" KMS keys e.g. "http://vault:8200"
+	//+optional
+	vaultAddress string,
+	// Hashicorp Vault token for "hashivault://" KMS keys
+	//+optional
+	vaultToken *dagger.Secret,
+	// Hashicorp Vault service bound to the host of the Vault address e.g. a local dev server
+	//+optional
+	vaultService *dagger.Service,
+	// cosign public key verifying the signing mode "key", derived from the private key if not provided
+	//+optional
+	cosignPublicKey *dagger.File,
+	// expected identity of the keyless signing certificate as regular expression e.g. "^https://github.com/org/repo/", required to publish in the signing mode "keyless"
+	//+optional
+	certificateIdentity string,
+	// expected OIDC issuer of the keyless signing certificate e.g. "https://token.actions.githubusercontent.com", required to publish in the signing mode "keyless"
+	//+optional
+	certificateOidcIssuer string,
+	// attest the lint, SAST and test reports to the published image as custom in-toto predicates
+	//+optional
+	attestReports bool,
+	// additional tags of the published image e.g. "1.4", "latest"
+	//+optional
+	tags []string,
+	// derive additional tags from the git tags and commit SHA of the source directory e.g. "1.4.2", "1.4", "1" and "sha-1a2b3c4"
+	//+optional
+	gitTags bool,
+	// mirror addresses registry/repository/image:tag the published image is copied to with its signatures and attestations
+	//+optional
+	mirrorAddresses []string,
+	// usernames of the mirrors' accounts, one for each mirror address
+	//+optional
+	mirrorUsernames []string,
+	// API keys, passwords or tokens to authenticate to the mirrors, one for each mirror address
+	//+optional
+	mirrorPasswords []*dagger.Secret,
+	// services bound to the hosts of the mirror addresses e.g. local registries accessed over plain HTTP, one for each mirror address
+	//+optional
+	mirrorServices []*dagger.Service,
+	// docker config.json with the credentials of the registry and the mirrors e.g. of robot accounts, used if no password is provided,
+	// only "auth" or "username" and "password" entries are supported, no identity tokens or credential helpers
+	//+optional
+	registryConfig *dagger.Secret,
+	// refuse to overwrite existing tags of the published image with a different digest
+	//+optional
+	protectTags bool,
+	// tags which may be overwritten despite the tag protection (default "latest"), the floating tags of a release e.g. "1.4" and "1" may always be
+	//+optional
+	mutableTags []string,
+	// quarantine repository registry/repository/image on the registry of the registry address, the image is published to it until all the steps succeeded
+	//+optional
+	quarantineRepository string,
+	// path of the Dockerfile within the source directory e.g. "docker/Dockerfile.prod"
+	//+optional
+	dockerfile string,
+	// target stage of the Dockerfile e.g. "runtime"
+	//+optional
+	buildTarget string,
+	// build arguments e.g. "VERSION=1.0.0"
+	//+optional
+	buildArgs []string,
+	// secrets available during the build, mounted with their name as id
+	//+optional
+	buildSecrets []*dagger.Secret,
+	// platforms to build the image for e.g. "linux/amd64", "linux/arm64"
+	//+optional
+	platforms []string,
+	// SBOM formats to create: "cyclonedx", "spdx" (default "cyclonedx"), the upload to deptrack requires "cyclonedx"
+	//+optional
+	sbomFormats []string,
+	// create a SBOM of the source directory e.g. from go.mod, package-lock.json, pom.xml
+	//+optional
+	sourceSbom bool,
+	// merge the source SBOM into the CycloneDX SBOM of the image
+	//+optional
+	mergeSbom bool,
 	// pre built app container
 	//+optional
 	appContainer *dagger.Container,
-) (*dagger.Directory, error) {
+	// minimum severity of vulnerabilities which blocks publishing e.g. "CRITICAL"
+	//+optional
+	vulnSeverity string,
+	// only consider vulnerabilities with an available fix for the vulnerability gate
+	//+optional
+	vulnFixableOnly bool,
+	// maximum number of allowed vulnerabilities by severity e.g. "HIGH=10"
+	//+optional
+	vulnMaxCounts []string,
+	// return the results of a run with failed steps instead of failing, the failures are only recorded in the status.json
+	//+optional
+	allowFailure bool,
+) (*PipelineResult, error) {
 	doLint := shouldRunStep(lintContainer, lintReportDir)
 	doSast := shouldRunStep(sastContainer, sastReportDir)
 	doTest := shouldRunStep(testContainer, testReportDir)
 	doIntTest := shouldRunStep(integrationTestContainer, integrationTestReportDir)
 	doBuild := appContainer == nil
+	buildOpts, err := newBuildOptions(dockerfile, buildTarget, buildArgs, buildSecrets, platforms)
+	if err != nil {
+		return nil, err
+	}
+	formats, err := newSbomFormats(sbomFormats, dtAddress != "")
+	if err != nil {
+		return nil, err
+	}
+	gate, err := newVulnerabilityGate(vulnSeverity, vulnFixableOnly, vulnMaxCounts)
+	if err != nil {
+		return nil, err
+	}
+	dtProject, err := newDeptrackProject(dtProjectUUID, dtProjectName, dtProjectVersion, dtParentProject, dtProjectTags, dtAutoCreate, registryAddress)
+	if err != nil {
+		return nil, err
+	}
+	dtGate, err := newDeptrackGate(dtWait, dtWaitTimeout, dtFailSeverity, dtFailViolationState, dtAddress != "" && dtApiKey != nil && dtProject.isSet())
+	if err != nil {
+		return nil, err
+	}
+	tags, err = newImageTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	var gitSource *dagger.Directory
+	if gitTags {
+		gitSource = dir
+	}
+	mirrors, err := newMirrors(mirrorAddresses, mirrorUsernames, mirrorPasswords, mirrorServices)
+	if err != nil {
+		return nil, err
+	}
+	protection := newTagProtection(protectTags, mutableTags)
+	quarantine, err := newQuarantine(quarantineRepository, registryAddress)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newSigner(signingMode, cosignKey, cosignPassword, kmsKey, vaultAddress, vaultToken, vaultService, cosignPublicKey, certificateIdentity, certificateOidcIssuer, registryAddress != "")
+	if err != nil {
+		return nil, err
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
+	// All the steps are only lazily chained here, they are evaluated concurrently in common
 	var lintReports *dagger.Directory
 	var securityReports *dagger.Directory
 	var testReports *dagger.Directory
 	var integrationTestReports *dagger.Directory
 	if doLint {
-		wg.Add(1)
-		lintReports = func() *dagger.Directory {
-			defer wg.Done()
-			return m.lint(lintContainer, lintReportDir)
-		}()
+		lintReports = m.lint(lintContainer, lintReportDir)
 	}
 	if doSast {
-		wg.Add(1)
-		securityReports = func() *dagger.Directory {
-			defer wg.Done()
-			return m.sast(sastContainer, sastReportDir)
-		}()
+		securityReports = m.sast(sastContainer, sastReportDir)
 	}
 	if doTest {
-		wg.Add(1)
-		testReports = func() *dagger.Directory {
-			defer wg.Done()
-			return m.test(testContainer, testReportDir)
-		}()
+		testReports = m.test(testContainer, testReportDir)
 	}
 	if doIntTest {
-		wg.Add(1)
-		integrationTestReports = func() *dagger.Directory {
-			defer wg.Done()
-			return m.intTest(integrationTestContainer, integrationTestReportDir)
-		}()
+		integrationTestReports = m.intTest(integrationTestContainer, integrationTestReportDir)
 	}
 
-	var vulnerabilityScan = func() *dagger.File {
-		defer wg.Done()
-		if doBuild {
-			return m.vulnscan(m.sbomBuild(ctx, dir))
-		}
-		return m.vulnscan(m.sbom(appContainer))
-	}()
-	var image = func() *dagger.Container {
-		defer wg.Done()
-		if doBuild {
-			return m.build(ctx, dir)
+	var variants []*imageVariant
+	var provenance *buildProvenance
+	if doBuild {
+		variants = m.buildVariants(ctx, dir, buildOpts, formats)
+		provenance = &buildProvenance{dir: dir, opts: buildOpts}
+	} else {
+		variants = []*imageVariant{m.newImageVariant("", appContainer, formats)}
+	}
+	var sourceSboms []sbomFile
+	if sourceSbom || mergeSbom {
+		sourceSboms, err = m.addSourceSboms(dir, formats, mergeSbom, registryAddress, variants)
+		if err != nil {
+			return nil, err
 		}
-		return appContainer
-	}()
-	// This Blocks the execution until its counter become 0
-	wg.Wait()
+	}
 
 	return m.common(
 		ctx,
@@ -135,18 +292,32 @@ func (m *PitcFlow) Flex(
 		securityReports,
 		testReports,
 		integrationTestReports,
-		vulnerabilityScan,
+		sourceSboms,
+		gate,
 		registryUsername,
 		registryPassword,
 		registryAddress,
+		registryConfig,
+		protection,
+		quarantine,
 		dtAddress,
-		dtProjectUUID,
 		dtApiKey,
-		image,
+		dtProject,
+		dtService,
+		dtGate,
+		dtAllowFailure,
+		signer,
+		provenance,
+		attestReports,
+		tags,
+		gitSource,
+		mirrors,
+		variants,
+		allowFailure,
 	)
 }
 
-// Executes all the steps and returns a directory with the results
+// Executes all the steps and returns the results, fails if a step failed unless failures are allowed
 func (m *PitcFlow) Full(
 	ctx context.Context,
 	// source directory
@@ -173,16 +344,149 @@ func (m *PitcFlow) Full(
 	registryPassword *dagger.Secret,
 	// registry address registry/repository/image:tag
 	registryAddress string,
-	// deptrack address for publishing the SBOM https://deptrack.example.com/api/v1/bom
+	// deptrack address https://deptrack.example.com or its BOM endpoint https://deptrack.example.com/api/v1/bom
 	dtAddress string,
 	// deptrack project UUID
 	dtProjectUUID string,
 	// deptrack API key
 	dtApiKey *dagger.Secret,
+	// deptrack project name, used instead of the project UUID
+	//+optional
+	dtProjectName string,
+	// deptrack project version, defaults to the tag of the registry address, required with the project name if the image is not published
+	//+optional
+	dtProjectVersion string,
+	// deptrack parent project UUID or name
+	//+optional
+	dtParentProject string,
+	// deptrack project tags
+	//+optional
+	dtProjectTags []string,
+	// create the deptrack project (version) if it does not exist yet
+	//+optional
+	dtAutoCreate bool,
+	// deptrack service bound to the host of the deptrack address e.g. a local instance
+	//+optional
+	dtService *dagger.Service,
+	// wait until deptrack analysed the SBOM and fetch the findings and policy violations
+	//+optional
+	dtWait bool,
+	// maximum time in seconds to wait for the deptrack analysis (default 300)
+	//+optional
+	dtWaitTimeout int,
+	// minimum severity of deptrack findings which blocks publishing e.g. "HIGH"
+	//+optional
+	dtFailSeverity string,
+	// minimum deptrack policy violation state which blocks publishing: "INFO", "WARN" or "FAIL"
+	//+optional
+	dtFailViolationState string,
+	// record a failed upload to deptrack without failing the pipeline, unless the deptrack gate depends on it
+	//+optional
+	dtAllowFailure bool,
+	// signing mode for image signatures and attestations: "keyless", "key" or "kms" (default "keyless")
+	//+optional
+	signingMode string,
+	// cosign private key for the signing mode "key"
+	//+optional
+	cosignKey *dagger.Secret,
+	// password of the cosign private key
+	//+optional
+	cosignPassword *dagger.Secret,
+	// KMS key URI for the signing mode "kms" e.g. "hashivault://cosign"
+	//+optional
+	kmsKey string,
+	// Hashicorp Vault address for "hashivault://" KMS keys e.g. "http://vault:8200"
+	//+optional
+	vaultAddress string,
+	// Hashicorp Vault token for "hashivault://" KMS keys
+	//+optional
+	vaultToken *dagger.Secret,
+	// Hashicorp Vault service bound to the host of the Vault address e.g. a local dev server
+	//+optional
+	vaultService *dagger.Service,
+	// cosign public key verifying the signing mode "key", derived from the private key if not provided
+	//+optional
+	cosignPublicKey *dagger.File,
+	// expected identity of the keyless signing certificate as regular expression e.g. "^https://github.com/org/repo/", required to publish in the signing mode "keyless"
+	//+optional
+	certificateIdentity string,
+	// expected OIDC issuer of the keyless signing certificate e.g. "https://token.actions.githubusercontent.com", required to publish in the signing mode "keyless"
+	//+optional
+	certificateOidcIssuer string,
+	// attest the lint, SAST and test reports to the published image as custom in-toto predicates
+	//+optional
+	attestReports bool,
+	// additional tags of the published image e.g. "1.4", "latest"
+	//+optional
+	tags []string,
+	// derive additional tags from the git tags and commit SHA of the source directory e.g. "1.4.2", "1.4", "1" and "sha-1a2b3c4"
+	//+optional
+	gitTags bool,
+	// mirror addresses registry/repository/image:tag the published image is copied to with its signatures and attestations
+	//+optional
+	mirrorAddresses []string,
+	// usernames of the mirrors' accounts, one for each mirror address
+	//+optional
+	mirrorUsernames []string,
+	// API keys, passwords or tokens to authenticate to the mirrors, one for each mirror address
+	//+optional
+	mirrorPasswords []*dagger.Secret,
+	// services bound to the hosts of the mirror addresses e.g. local registries accessed over plain HTTP, one for each mirror address
+	//+optional
+	mirrorServices []*dagger.Service,
+	// docker config.json with the credentials of the registry and the mirrors e.g. of robot accounts, used if no password is provided,
+	// only "auth" or "username" and "password" entries are supported, no identity tokens or credential helpers
+	//+optional
+	registryConfig *dagger.Secret,
+	// refuse to overwrite existing tags of the published image with a different digest
+	//+optional
+	protectTags bool,
+	// tags which may be overwritten despite the tag protection (default "latest"), the floating tags of a release e.g. "1.4" and "1" may always be
+	//+optional
+	mutableTags []string,
+	// quarantine repository registry/repository/image on the registry of the registry address, the image is published to it until all the steps succeeded
+	//+optional
+	quarantineRepository string,
+	// path of the Dockerfile within the source directory e.g. "docker/Dockerfile.prod"
+	//+optional
+	dockerfile string,
+	// target stage of the Dockerfile e.g. "runtime"
+	//+optional
+	buildTarget string,
+	// build arguments e.g. "VERSION=1.0.0"
+	//+optional
+	buildArgs []string,
+	// secrets available during the build, mounted with their name as id
+	//+optional
+	buildSecrets []*dagger.Secret,
+	// platforms to build the image for e.g. "linux/amd64", "linux/arm64"
+	//+optional
+	platforms []string,
+	// SBOM formats to create: "cyclonedx", "spdx" (default "cyclonedx"), the upload to deptrack requires "cyclonedx"
+	//+optional
+	sbomFormats []string,
+	// create a SBOM of the source directory e.g. from go.mod, package-lock.json, pom.xml
+	//+optional
+	sourceSbom bool,
+	// merge the source SBOM into the CycloneDX SBOM of the image
+	//+optional
+	mergeSbom bool,
 	// pre built app container
 	//+optional
 	appContainer *dagger.Container,
-) (*dagger.Directory, error) {
+	// minimum severity of vulnerabilities which blocks publishing e.g. "CRITICAL"
+	//+optional
+	vulnSeverity string,
+	// only consider vulnerabilities with an available fix for the vulnerability gate
+	//+optional
+	vulnFixableOnly bool,
+	// maximum number of allowed vulnerabilities by severity e.g. "HIGH=10"
+	//+optional
+	vulnMaxCounts []string,
+	// return the results of a run with failed steps instead of failing, the failures are only recorded in the status.json
+	//+optional
+	allowFailure bool,
+) (*PipelineResult, error) {
 	return m.Flex(
 		ctx,
 		dir,
@@ -200,11 +504,55 @@ func (m *PitcFlow) Full(
 		dtAddress,
 		dtProjectUUID,
 		dtApiKey,
+		dtProjectName,
+		dtProjectVersion,
+		dtParentProject,
+		dtProjectTags,
+		dtAutoCreate,
+		dtService,
+		dtWait,
+		dtWaitTimeout,
+		dtFailSeverity,
+		dtFailViolationState,
+		dtAllowFailure,
+		signingMode,
+		cosignKey,
+		cosignPassword,
+		kmsKey,
+		vaultAddress,
+		vaultToken,
+		vaultService,
+		cosignPublicKey,
+		certificateIdentity,
+		certificateOidcIssuer,
+		attestReports,
+		tags,
+		gitTags,
+		mirrorAddresses,
+		mirrorUsernames,
+		mirrorPasswords,
+		mirrorServices,
+		registryConfig,
+		protectTags,
+		mutableTags,
+		quarantineRepository,
+		dockerfile,
+		buildTarget,
+		buildArgs,
+		buildSecrets,
+		platforms,
+		sbomFormats,
+		sourceSbom,
+		mergeSbom,
 		appContainer,
+		vulnSeverity,
+		vulnFixableOnly,
+		vulnMaxCounts,
+		allowFailure,
 	)
 }
 
-// Executes all the CI steps (no publishing) and returns a directory with the results
+// Executes all the CI steps (no publishing) and returns the results, fails if a step failed unless failures are allowed
 func (m *PitcFlow) Ci(
 	ctx context.Context,
 	// source directory
@@ -225,10 +573,46 @@ func (m *PitcFlow) Ci(
 	integrationTestContainer *dagger.Container,
 	// integration test report folder name e.g. "/mnt/int-test/reports"
 	integrationTestReportDir string,
+	// path of the Dockerfile within the source directory e.g. "docker/Dockerfile.prod"
+	//+optional
+	dockerfile string,
+	// target stage of the Dockerfile e.g. "runtime"
+	//+optional
+	buildTarget string,
+	// build arguments e.g. "VERSION=1.0.0"
+	//+optional
+	buildArgs []string,
+	// secrets available during the build, mounted with their name as id
+	//+optional
+	buildSecrets []*dagger.Secret,
+	// platforms to build the image for e.g. "linux/amd64", "linux/arm64"
+	//+optional
+	platforms []string,
+	// SBOM formats to create: "cyclonedx", "spdx" (default "cyclonedx"), the upload to deptrack requires "cyclonedx"
+	//+optional
+	sbomFormats []string,
+	// create a SBOM of the source directory e.g. from go.mod, package-lock.json, pom.xml
+	//+optional
+	sourceSbom bool,
+	// merge the source SBOM into the CycloneDX SBOM of the image
+	//+optional
+	mergeSbom bool,
 	// pre built app container
 	//+optional
 	appContainer *dagger.Container,
-) (*dagger.Directory, error) {
+	// minimum severity of vulnerabilities which blocks publishing e.g. "CRITICAL"
+	//+optional
+	vulnSeverity string,
+	// only consider vulnerabilities with an available fix for the vulnerability gate
+	//+optional
+	vulnFixableOnly bool,
+	// maximum number of allowed vulnerabilities by severity e.g. "HIGH=10"
+	//+optional
+	vulnMaxCounts []string,
+	// return the results of a run with failed steps instead of failing, the failures are only recorded in the status.json
+	//+optional
+	allowFailure bool,
+) (*PipelineResult, error) {
 	return m.Flex(
 		ctx,
 		dir,
@@ -246,11 +630,55 @@ func (m *PitcFlow) Ci(
 		"",
 		"",
 		nil,
+		"",
+		"",
+		"",
+		nil,
+		false,
+		nil,
+		false,
+		0,
+		"",
+		"",
+		false,
+		"",
+		nil,
+		nil,
+		"",
+		"",
+		nil,
+		nil,
+		nil,
+		"",
+		"",
+		false,
+		nil,
+		false,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		false,
+		nil,
+		"",
+		dockerfile,
+		buildTarget,
+		buildArgs,
+		buildSecrets,
+		platforms,
+		sbomFormats,
+		sourceSbom,
+		mergeSbom,
 		appContainer,
+		vulnSeverity,
+		vulnFixableOnly,
+		vulnMaxCounts,
+		allowFailure,
 	)
 }
 
-// Executes only the desired steps and returns a directory with the results (interface variant)
+// Executes only the desired steps and returns the results, fails if a step failed unless failures are allowed (interface variant)
 func (m *PitcFlow) IFlex(
 	ctx context.Context,
 	// source directory
@@ -276,7 +704,7 @@ func (m *PitcFlow) IFlex(
 	// registry address registry/repository/image:tag
 	//+optional
 	registryAddress string,
-	// deptrack address for publishing the SBOM https://deptrack.example.com/api/v1/bom
+	// deptrack address https://deptrack.example.com or its BOM endpoint https://deptrack.example.com/api/v1/bom
 	//+optional
 	dtAddress string,
 	// deptrack project UUID
@@ -285,34 +713,206 @@ func (m *PitcFlow) IFlex(
 	// deptrack API key
 	//+optional
 	dtApiKey *dagger.Secret,
+	// deptrack project name, used instead of the project UUID
+	//+optional
+	dtProjectName string,
+	// deptrack project version, defaults to the tag of the registry address, required with the project name if the image is not published
+	//+optional
+	dtProjectVersion string,
+	// deptrack parent project UUID or name
+	//+optional
+	dtParentProject string,
+	// deptrack project tags
+	//+optional
+	dtProjectTags []string,
+	// create the deptrack project (version) if it does not exist yet
+	//+optional
+	dtAutoCreate bool,
+	// deptrack service bound to the host of the deptrack address e.g. a local instance
+	//+optional
+	dtService *dagger.Service,
+	// wait until deptrack analysed the SBOM and fetch the findings and policy violations
+	//+optional
+	dtWait bool,
+	// maximum time in seconds to wait for the deptrack analysis (default 300)
+	//+optional
+	dtWaitTimeout int,
+	// minimum severity of deptrack findings which blocks publishing e.g. "HIGH"
+	//+optional
+	dtFailSeverity string,
+	// minimum deptrack policy violation state which blocks publishing: "INFO", "WARN" or "FAIL"
+	//+optional
+	dtFailViolationState string,
+	// record a failed upload to deptrack without failing the pipeline, unless the deptrack gate depends on it
+	//+optional
+	dtAllowFailure bool,
+	// signing mode for image signatures and attestations: "keyless", "key" or "kms" (default "keyless")
+	//+optional
+	signingMode string,
+	// cosign private key for the signing mode "key"
+	//+optional
+	cosignKey *dagger.Secret,
+	// password of the cosign private key
+	//+optional
+	cosignPassword *dagger.Secret,
+	// KMS key URI for the signing mode "kms" e.g. "hashivault://cosign"
+	//+optional
+	kmsKey string,
+	// Hashicorp Vault address for "hashivault://" KMS keys e.g. "http://vault:8200"
+	//+optional
+	vaultAddress string,
+	// Hashicorp Vault token for "hashivault://" KMS keys
+	//+optional
+	vaultToken *dagger.Secret,
+	// Hashicorp Vault service bound to the host of the Vault address e.g. a local dev server
+	//+optional
+	vaultService *dagger.Service,
+	// cosign public key verifying the signing mode "key", derived from the private key if not provided
+	//+optional
+	cosignPublicKey *dagger.File,
+	// expected identity of the keyless signing certificate as regular expression e.g. "^https://github.com/org/repo/", required to publish in the signing mode "keyless"
+	//+optional
+	certificateIdentity string,
+	// expected OIDC issuer of the keyless signing certificate e.g. "https://token.actions.githubusercontent.com", required to publish in the signing mode "keyless"
+	//+optional
+	certificateOidcIssuer string,
+	// attest the lint, SAST and test reports to the published image as custom in-toto predicates
+	//+optional
+	attestReports bool,
+	// additional tags of the published image e.g. "1.4", "latest"
+	//+optional
+	tags []string,
+	// derive additional tags from the git tags and commit SHA of the source directory e.g. "1.4.2", "1.4", "1" and "sha-1a2b3c4"
+	//+optional
+	gitTags bool,
+	// mirror addresses registry/repository/image:tag the published image is copied to with its signatures and attestations
+	//+optional
+	mirrorAddresses []string,
+	// usernames of the mirrors' accounts, one for each mirror address
+	//+optional
+	mirrorUsernames []string,
+	// API keys, passwords or tokens to authenticate to the mirrors, one for each mirror address
+	//+optional
+	mirrorPasswords []*dagger.Secret,
+	// services bound to the hosts of the mirror addresses e.g. local registries accessed over plain HTTP, one for each mirror address
+	//+optional
+	mirrorServices []*dagger.Service,
+	// docker config.json with the credentials of the registry and the mirrors e.g. of robot accounts, used if no password is provided,
+	// only "auth" or "username" and "password" entries are supported, no identity tokens or credential helpers
+	//+optional
+	registryConfig *dagger.Secret,
+	// refuse to overwrite existing tags of the published image with a different digest
+	//+optional
+	protectTags bool,
+	// tags which may be overwritten despite the tag protection (default "latest"), the floating tags of a release e.g. "1.4" and "1" may always be
+	//+optional
+	mutableTags []string,
+	// quarantine repository registry/repository/image on the registry of the registry address, the image is published to it until all the steps succeeded
+	//+optional
+	quarantineRepository string,
+	// path of the Dockerfile within the source directory e.g. "docker/Dockerfile.prod"
+	//+optional
+	dockerfile string,
+	// target stage of the Dockerfile e.g. "runtime"
+	//+optional
+	buildTarget string,
+	// build arguments e.g. "VERSION=1.0.0"
+	//+optional
+	buildArgs []string,
+	// secrets available during the build, mounted with their name as id
+	//+optional
+	buildSecrets []*dagger.Secret,
+	// platforms to build the image for e.g. "linux/amd64", "linux/arm64"
+	//+optional
+	platforms []string,
+	// SBOM formats to create: "cyclonedx", "spdx" (default "cyclonedx"), the upload to deptrack requires "cyclonedx"
+	//+optional
+	sbomFormats []string,
+	// create a SBOM of the source directory e.g. from go.mod, package-lock.json, pom.xml
+	//+optional
+	sourceSbom bool,
+	// merge the source SBOM into the CycloneDX SBOM of the image
+	//+optional
+	mergeSbom bool,
 	// pre built app container
 	//+optional
 	appContainer *dagger.Container,
-) (*dagger.Directory, error) {
+	// minimum severity of vulnerabilities which blocks publishing e.g. "CRITICAL"
+	//+optional
+	vulnSeverity string,
+	// only consider vulnerabilities with an available fix for the vulnerability gate
+	//+optional
+	vulnFixableOnly bool,
+	// maximum number of allowed vulnerabilities by severity e.g. "HIGH=10"
+	//+optional
+	vulnMaxCounts []string,
+	// return the results of a run with failed steps instead of failing, the failures are only recorded in the status.json
+	//+optional
+	allowFailure bool,
+) (*PipelineResult, error) {
 	doLint := lintReports != nil
 	doSast := securityReports != nil
 	doTest := testReports != nil
 	doIntTest := integrationTestReports != nil
 	doBuild := appContainer == nil
+	buildOpts, err := newBuildOptions(dockerfile, buildTarget, buildArgs, buildSecrets, platforms)
+	if err != nil {
+		return nil, err
+	}
+	formats, err := newSbomFormats(sbomFormats, dtAddress != "")
+	if err != nil {
+		return nil, err
+	}
+	gate, err := newVulnerabilityGate(vulnSeverity, vulnFixableOnly, vulnMaxCounts)
+	if err != nil {
+		return nil, err
+	}
+	dtProject, err := newDeptrackProject(dtProjectUUID, dtProjectName, dtProjectVersion, dtParentProject, dtProjectTags, dtAutoCreate, registryAddress)
+	if err != nil {
+		return nil, err
+	}
+	dtGate, err := newDeptrackGate(dtWait, dtWaitTimeout, dtFailSeverity, dtFailViolationState, dtAddress != "" && dtApiKey != nil && dtProject.isSet())
+	if err != nil {
+		return nil, err
+	}
+	tags, err = newImageTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	var gitSource *dagger.Directory
+	if gitTags {
+		gitSource = dir
+	}
+	mirrors, err := newMirrors(mirrorAddresses, mirrorUsernames, mirrorPasswords, mirrorServices)
+	if err != nil {
+		return nil, err
+	}
+	protection := newTagProtection(protectTags, mutableTags)
+	quarantine, err := newQuarantine(quarantineRepository, registryAddress)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := newSigner(signingMode, cosignKey, cosignPassword, kmsKey, vaultAddress, vaultToken, vaultService, cosignPublicKey, certificateIdentity, certificateOidcIssuer, registryAddress != "")
+	if err != nil {
+		return nil, err
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	var vulnerabilityScan = func() *dagger.File {
-		defer wg.Done()
-		if doBuild {
-			return m.vulnscan(m.sbomBuild(ctx, dir))
-		}
-		return m.vulnscan(m.sbom(appContainer))
-	}()
-	var image = func() *dagger.Container {
-		defer wg.Done()
-		if doBuild {
-			return m.build(ctx, dir)
+	// The steps are only lazily chained here, they are evaluated concurrently in common
+	var variants []*imageVariant
+	var provenance *buildProvenance
+	if doBuild {
+		variants = m.buildVariants(ctx, dir, buildOpts, formats)
+		provenance = &buildProvenance{dir: dir, opts: buildOpts}
+	} else {
+		variants = []*imageVariant{m.newImageVariant("", appContainer, formats)}
+	}
+	var sourceSboms []sbomFile
+	if sourceSbom || mergeSbom {
+		sourceSboms, err = m.addSourceSboms(dir, formats, mergeSbom, registryAddress, variants)
+		if err != nil {
+			return nil, err
 		}
-		return appContainer
-	}()
-	// This Blocks the execution until its counter become 0
-	wg.Wait()
+	}
 
 	return m.common(
 		ctx,
@@ -324,18 +924,32 @@ func (m *PitcFlow) IFlex(
 		securityReports,
 		testReports,
 		integrationTestReports,
-		vulnerabilityScan,
+		sourceSboms,
+		gate,
 		registryUsername,
 		registryPassword,
 		registryAddress,
+		registryConfig,
+		protection,
+		quarantine,
 		dtAddress,
-		dtProjectUUID,
 		dtApiKey,
-		image,
+		dtProject,
+		dtService,
+		dtGate,
+		dtAllowFailure,
+		signer,
+		provenance,
+		attestReports,
+		tags,
+		gitSource,
+		mirrors,
+		variants,
+		allowFailure,
 	)
 }
 
-// Executes all the steps and returns a directory with the results (interface variant)
+// Executes all the steps and returns the results, fails if a step failed unless failures are allowed (interface variant)
 func (m *PitcFlow) IFull(
 	ctx context.Context,
 	// source directory
@@ -354,16 +968,149 @@ func (m *PitcFlow) IFull(
 	registryPassword *dagger.Secret,
 	// registry address registry/repository/image:tag
 	registryAddress string,
-	// deptrack address for publishing the SBOM https://deptrack.example.com/api/v1/bom
+	// deptrack address https://deptrack.example.com or its BOM endpoint https://deptrack.example.com/api/v1/bom
 	dtAddress string,
 	// deptrack project UUID
 	dtProjectUUID string,
 	// deptrack API key
 	dtApiKey *dagger.Secret,
+	// deptrack project name, used instead of the project UUID
+	//+optional
+	dtProjectName string,
+	// deptrack project version, defaults to the tag of the registry address, required with the project name if the image is not published
+	//+optional
+	dtProjectVersion string,
+	// deptrack parent project UUID or name
+	//+optional
+	dtParentProject string,
+	// deptrack project tags
+	//+optional
+	dtProjectTags []string,
+	// create the deptrack project (version) if it does not exist yet
+	//+optional
+	dtAutoCreate bool,
+	// deptrack service bound to the host of the deptrack address e.g. a local instance
+	//+optional
+	dtService *dagger.Service,
+	// wait until deptrack analysed the SBOM and fetch the findings and policy violations
+	//+optional
+	dtWait bool,
+	// maximum time in seconds to wait for the deptrack analysis (default 300)
+	//+optional
+	dtWaitTimeout int,
+	// minimum severity of deptrack findings which blocks publishing e.g. "HIGH"
+	//+optional
+	dtFailSeverity string,
+	// minimum deptrack policy violation state which blocks publishing: "INFO", "WARN" or "FAIL"
+	//+optional
+	dtFailViolationState string,
+	// record a failed upload to deptrack without failing the pipeline, unless the deptrack gate depends on it
+	//+optional
+	dtAllowFailure bool,
+	// signing mode for image signatures and attestations: "keyless", "key" or "kms" (default "keyless")
+	//+optional
+	signingMode string,
+	// cosign private key for the signing mode "key"
+	//+optional
+	cosignKey *dagger.Secret,
+	// password of the cosign private key
+	//+optional
+	cosignPassword *dagger.Secret,
+	// KMS key URI for the signing mode "kms" e.g. "hashivault://cosign"
+	//+optional
+	kmsKey string,
+	// Hashicorp Vault address for "hashivault://" KMS keys e.g. "http://vault:8200"
+	//+optional
+	vaultAddress string,
+	// Hashicorp Vault token for "hashivault://" KMS keys
+	//+optional
+	vaultToken *dagger.Secret,
+	// Hashicorp Vault service bound to the host of the Vault address e.g. a local dev server
+	//+optional
+	vaultService *dagger.Service,
+	// cosign public key verifying the signing mode "key", derived from the private key if not provided
+	//+optional
+	cosignPublicKey *dagger.File,
+	// expected identity of the keyless signing certificate as regular expression e.g. "^https://github.com/org/repo/", required to publish in the signing mode "keyless"
+	//+optional
+	certificateIdentity string,
+	// expected OIDC issuer of the keyless signing certificate e.g. "https://token.actions.githubusercontent.com", required to publish in the signing mode "keyless"
+	//+optional
+	certificateOidcIssuer string,
+	// attest the lint, SAST and test reports to the published image as custom in-toto predicates
+	//+optional
+	attestReports bool,
+	// additional tags of the published image e.g. "1.4", "latest"
+	//+optional
+	tags []string,
+	// derive additional tags from the git tags and commit SHA of the source directory e.g. "1.4.2", "1.4", "1" and "sha-1a2b3c4"
+	//+optional
+	gitTags bool,
+	// mirror addresses registry/repository/image:tag the published image is copied to with its signatures and attestations
+	//+optional
+	mirrorAddresses []string,
+	// usernames of the mirrors' accounts, one for each mirror address
+	//+optional
+	mirrorUsernames []string,
+	// API keys, passwords or tokens to authenticate to the mirrors, one for each mirror address
+	//+optional
+	mirrorPasswords []*dagger.Secret,
+	// services bound to the hosts of the mirror addresses e.g. local registries accessed over plain HTTP, one for each mirror address
+	//+optional
+	mirrorServices []*dagger.Service,
+	// docker config.json with the credentials of the registry and the mirrors e.g. of robot accounts, used if no password is provided,
+	// only "auth" or "username" and "password" entries are supported, no identity tokens or credential helpers
+	//+optional
+	registryConfig *dagger.Secret,
+	// refuse to overwrite existing tags of the published image with a different digest
+	//+optional
+	protectTags bool,
+	// tags which may be overwritten despite the tag protection (default "latest"), the floating tags of a release e.g. "1.4" and "1" may always be
+	//+optional
+	mutableTags []string,
+	// quarantine repository registry/repository/image on the registry of the registry address, the image is published to it until all the steps succeeded
+	//+optional
+	quarantineRepository string,
+	// path of the Dockerfile within the source directory e.g. "docker/Dockerfile.prod"
+	//+optional
+	dockerfile string,
+	// target stage of the Dockerfile e.g. "runtime"
+	//+optional
+	buildTarget string,
+	// build arguments e.g. "VERSION=1.0.0"
+	//+optional
+	buildArgs []string,
+	// secrets available during the build, mounted with their name as id
+	//+optional
+	buildSecrets []*dagger.Secret,
+	// platforms to build the image for e.g. "linux/amd64", "linux/arm64"
+	//+optional
+	platforms []string,
+	// SBOM formats to create: "cyclonedx", "spdx" (default "cyclonedx"), the upload to deptrack requires "cyclonedx"
+	//+optional
+	sbomFormats []string,
+	// create a SBOM of the source directory e.g. from go.mod, package-lock.json, pom.xml
+	//+optional
+	sourceSbom bool,
+	// merge the source SBOM into the CycloneDX SBOM of the image
+	//+optional
+	mergeSbom bool,
 	// pre built app container
 	//+optional
 	appContainer *dagger.Container,
-) (*dagger.Directory, error) {
+	// minimum severity of vulnerabilities which blocks publishing e.g. "CRITICAL"
+	//+optional
+	vulnSeverity string,
+	// only consider vulnerabilities with an available fix for the vulnerability gate
+	//+optional
+	vulnFixableOnly bool,
+	// maximum number of allowed vulnerabilities by severity e.g. "HIGH=10"
+	//+optional
+	vulnMaxCounts []string,
+	// return the results of a run with failed steps instead of failing, the failures are only recorded in the status.json
+	//+optional
+	allowFailure bool,
+) (*PipelineResult, error) {
 	return m.IFlex(
 		ctx,
 		dir,
@@ -377,11 +1124,55 @@ func (m *PitcFlow) IFull(
 		dtAddress,
 		dtProjectUUID,
 		dtApiKey,
+		dtProjectName,
+		dtProjectVersion,
+		dtParentProject,
+		dtProjectTags,
+		dtAutoCreate,
+		dtService,
+		dtWait,
+		dtWaitTimeout,
+		dtFailSeverity,
+		dtFailViolationState,
+		dtAllowFailure,
+		signingMode,
+		cosignKey,
+		cosignPassword,
+		kmsKey,
+		vaultAddress,
+		vaultToken,
+		vaultService,
+		cosignPublicKey,
+		certificateIdentity,
+		certificateOidcIssuer,
+		attestReports,
+		tags,
+		gitTags,
+		mirrorAddresses,
+		mirrorUsernames,
+		mirrorPasswords,
+		mirrorServices,
+		registryConfig,
+		protectTags,
+		mutableTags,
+		quarantineRepository,
+		dockerfile,
+		buildTarget,
+		buildArgs,
+		buildSecrets,
+		platforms,
+		sbomFormats,
+		sourceSbom,
+		mergeSbom,
 		appContainer,
+		vulnSeverity,
+		vulnFixableOnly,
+		vulnMaxCounts,
+		allowFailure,
 	)
 }
 
-// Executes all the CI steps (no publishing) and returns a directory with the results (interface variant)
+// Executes all the CI steps (no publishing) and returns the results, fails if a step failed unless failures are allowed (interface variant)
 func (m *PitcFlow) ICi(
 	ctx context.Context,
 	// source directory
@@ -394,10 +1185,46 @@ func (m *PitcFlow) ICi(
 	testReports *dagger.Directory,
 	// directory containing the integration test results
 	integrationTestReports *dagger.Directory,
+	// path of the Dockerfile within the source directory e.g. "docker/Dockerfile.prod"
+	//+optional
+	dockerfile string,
+	// target stage of the Dockerfile e.g. "runtime"
+	//+optional
+	buildTarget string,
+	// build arguments e.g. "VERSION=1.0.0"
+	//+optional
+	buildArgs []string,
+	// secrets available during the build, mounted with their name as id
+	//+optional
+	buildSecrets []*dagger.Secret,
+	// platforms to build the image for e.g. "linux/amd64", "linux/arm64"
+	//+optional
+	platforms []string,
+	// SBOM formats to create: "cyclonedx", "spdx" (default "cyclonedx"), the upload to deptrack requires "cyclonedx"
+	//+optional
+	sbomFormats []string,
+	// create a SBOM of the source directory e.g. from go.mod, package-lock.json, pom.xml
+	//+optional
+	sourceSbom bool,
+	// merge the source SBOM into the CycloneDX SBOM of the image
+	//+optional
+	mergeSbom bool,
 	// pre built app container
 	//+optional
 	appContainer *dagger.Container,
-) (*dagger.Directory, error) {
+	// minimum severity of vulnerabilities which blocks publishing e.g. "CRITICAL"
+	//+optional
+	vulnSeverity string,
+	// only consider vulnerabilities with an available fix for the vulnerability gate
+	//+optional
+	vulnFixableOnly bool,
+	// maximum number of allowed vulnerabilities by severity e.g. "HIGH=10"
+	//+optional
+	vulnMaxCounts []string,
+	// return the results of a run with failed steps instead of failing, the failures are only recorded in the status.json
+	//+optional
+	allowFailure bool,
+) (*PipelineResult, error) {
 	return m.IFlex(
 		ctx,
 		dir,
@@ -411,22 +1238,81 @@ func (m *PitcFlow) ICi(
 		"",
 		"",
 		nil,
+		"",
+		"",
+		"",
+		nil,
+		false,
+		nil,
+		false,
+		0,
+		"",
+		"",
+		false,
+		"",
+		nil,
+		nil,
+		"",
+		"",
+		nil,
+		nil,
+		nil,
+		"",
+		"",
+		false,
+		nil,
+		false,
+		nil,
+		nil,
+		nil,
+		nil,
+		nil,
+		false,
+		nil,
+		"",
+		dockerfile,
+		buildTarget,
+		buildArgs,
+		buildSecrets,
+		platforms,
+		sbomFormats,
+		sourceSbom,
+		mergeSbom,
 		appContainer,
+		vulnSeverity,
+		vulnFixableOnly,
+		vulnMaxCounts,
+		allowFailure,
 	)
 }
 
-// Verifies if the run was succesful and returns the error messages
+// Verifies if the run was succesful and returns the error messages of the failed steps
 func (m *PitcFlow) Verify(
 	ctx context.Context,
-	// status.txt file to be verified
+	// status.json file to be verified
 	status *dagger.File,
 ) (string, error) {
 	content, err := status.Contents(ctx)
 	if err != nil {
 		return "", err
 	}
-	if content != "" {
-		return content, fmt.Errorf("%w", content)
+	var runStatus pipelineStatus
+	if err := json.Unmarshal([]byte(content), &runStatus); err != nil {
+		return "", fmt.Errorf("failed to parse the status file: %w", err)
+	}
+	if runStatus.Version != statusVersion {
+		return "", fmt.Errorf("unsupported status file version %d, expected %d", runStatus.Version, statusVersion)
+	}
+
+	var failures []string
+	for _, s := range runStatus.Steps {
+		if s.Status == statusFailed {
+			failures = append(failures, fmt.Sprintf("%s: %s", s.Name, s.Error))
+		}
+	}
+	if len(failures) > 0 {
+		message := strings.Join(failures, "\n")
+		return message, fmt.Errorf("one or more steps failed:\n%s", message)
 	}
 	return "", nil
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"fmt"
+	"strings"
+)
+
+// Creates the mirror targets, the credentials and services are either omitted or provided for every mirror
+func newMirrors(
+	addresses []string,
+	usernames []string,
+	passwords []*dagger.Secret,
+	services []*dagger.Service,
+) ([]registryTarget, error) {
+	if len(usernames) > 0 && len(usernames) != len(addresses) {
+		return nil, fmt.Errorf("expected %d mirror usernames, got %d", len(addresses), len(usernames))
+	}
+	if len(passwords) > 0 && len(passwords) != len(addresses) {
+		return nil, fmt.Errorf("expected %d mirror passwords, got %d", len(addresses), len(passwords))
+	}
+	if len(services) > 0 && len(services) != len(addresses) {
+		return nil, fmt.Errorf("expected %d mirror services, got %d", len(addresses), len(services))
+	}
+	mirrors := make([]registryTarget, 0, len(addresses))
+	for i, address := range addresses {
+		mirror := registryTarget{address: address}
+		if len(usernames) > 0 {
+			mirror.username = usernames[i]
+		}
+		if len(passwords) > 0 {
+			mirror.password = passwords[i]
+		}
+		if len(services) > 0 {
+			mirror.service = services[i]
+		}
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors, nil
+}
+
+// Copies the published image with its signatures and attestations to the mirror and returns the reference of the copy
+func (m *PitcFlow) mirror(
+	ctx context.Context,
+	// registry the image was published to
+	source registryTarget,
+	// digest of the published image
+	digest string,
+	// registry the image is copied to
+	target registryTarget,
+) (string, error) {
+	args := []string{"copy", "--force"}
+	// local registries bound as services are only reachable over plain HTTP
+	if target.service != nil || source.service != nil {
+		args = append(args, "--allow-http-registry")
+	}
+	_, err := cosignContainer(source, target).
+		WithExec(append(args, digest, target.address), dagger.ContainerWithExecOpts{UseEntrypoint: true}).
+		Sync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy the image to %s: %w", target.address, err)
+	}
+	name, _ := splitImageAddress(target.address)
+	_, imageDigest, _ := strings.Cut(digest, "@")
+	return name + "@" + imageDigest, nil
+}
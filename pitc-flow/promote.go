@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Format version of the promotion.json record
+const promotionVersion = 1
+
+// Attestations required for a promotion by default
+var defaultPromotionAttestations = []string{"cyclonedx", vulnPredicateType, provenancePredicateType}
+
+// The result of a promotion
+type PromotionResult struct {
+	// source image reference with digest
+	Source string
+	// target image reference with digest
+	Target string
+	// digest of the promoted image
+	Digest string
+	// names of the verified attestations
+	Attestations []string
+	// directory containing the verification outputs and the promotion record promotion.json
+	Directory *dagger.Directory
+	// machine-readable promotion.json record
+	Record *dagger.File
+}
+
+// Content of the promotion.json file
+type promotionRecord struct {
+	Version      int       `json:"version"`
+	Source       string    `json:"source"`
+	Target       string    `json:"target"`
+	Digest       string    `json:"digest"`
+	SigningMode  string    `json:"signingMode"`
+	Attestations []string  `json:"attestations"`
+	PromotedAt   time.Time `json:"promotedAt"`
+}
+
+// Returns the predicate types of the attestations created by the pipeline by their name
+func attestationPredicateTypes() map[string]string {
+	predicateTypes := map[string]string{
+		vulnPredicateType:       vulnPredicateType,
+		provenancePredicateType: provenancePredicateType,
+	}
+	for _, format := range supportedSbomFormats {
+		predicateTypes[format.predicateType] = format.predicateType
+	}
+	for name, predicateType := range reportPredicateTypes {
+		predicateTypes[name] = predicateType
+	}
+	return predicateTypes
+}
+
+// Resolves the digest of the image reference e.g. "sha256:abc", the digest of a reference by digest is used as it is
+func (m *PitcFlow) resolveDigest(ctx context.Context, registry registryTarget) (string, error) {
+	if _, digest, found := strings.Cut(registry.address, "@"); found {
+		return digest, nil
+	}
+	args := []string{"digest"}
+	if registry.service != nil {
+		args = append(args, "--insecure")
+	}
+	digest, err := craneContainer(registry).
+		WithExec(append(args, registry.address), dagger.ContainerWithExecOpts{UseEntrypoint: true}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the digest of %s: %w", registry.address, err)
+	}
+	return strings.TrimSpace(digest), nil
+}
+
+// Promotes a signed image by digest to the target registry, once its signature and the required attestations are verified
+func (m *PitcFlow) Promote(
+	ctx context.Context,
+	// source image reference registry/repository/image:tag or registry/repository/image@digest
+	source string,
+	// target address registry/repository/image:tag
+	target string,
+	// Username of the source registry's account
+	//+optional
+	sourceUsername string,
+	// API key, password or token to authenticate to the source registry
+	//+optional
+	sourcePassword *dagger.Secret,
+	// service bound to the host of the source e.g. a local registry accessed over plain HTTP
+	//+optional
+	sourceService *dagger.Service,
+	// Username of the target registry's account
+	//+optional
+	targetUsername string,
+	// API key, password or token to authenticate to the target registry
+	//+optional
+	targetPassword *dagger.Secret,
+	// service bound to the host of the target e.g. a local registry accessed over plain HTTP
+	//+optional
+	targetService *dagger.Service,
+	// signing mode of the source image: "keyless", "key" or "kms" (default "keyless")
+	//+optional
+	signingMode string,
+	// cosign public key verifying the signing mode "key"
+	//+optional
+	cosignPublicKey *dagger.File,
+	// KMS key URI verifying the signing mode "kms" e.g. "hashivault://cosign"
+	//+optional
+	kmsKey string,
+	// Hashicorp Vault address for "hashivault://" KMS keys e.g. "http://vault:8200"
+	//+optional
+	vaultAddress string,
+	// Hashicorp Vault token for "hashivault://" KMS keys
+	//+optional
+	vaultToken *dagger.Secret,
+	// Hashicorp Vault service bound to the host of the Vault address e.g. a local dev server
+	//+optional
+	vaultService *dagger.Service,
+	// expected identity of the keyless signing certificate as regular expression e.g. "^https://github.com/org/repo/"
+	//+optional
+	certificateIdentity string,
+	// expected OIDC issuer of the keyless signing certificate e.g. "https://token.actions.githubusercontent.com"
+	//+optional
+	certificateOidcIssuer string,
+	// attestations required for the promotion e.g. "cyclonedx", "spdxjson", "vuln", "slsaprovenance1" or "lint" (default "cyclonedx", "vuln" and "slsaprovenance1")
+	//+optional
+	requiredAttestations []string,
+	// docker config.json with the credentials of the source and target registries, used if they have no password,
+	// only "auth" or "username" and "password" entries are supported, no identity tokens or credential helpers
+	//+optional
+	registryConfig *dagger.Secret,
+) (*PromotionResult, error) {
+	verifier, err := newVerifier(signingMode, cosignPublicKey, kmsKey, vaultAddress, vaultToken, vaultService, certificateIdentity, certificateOidcIssuer)
+	if err != nil {
+		return nil, err
+	}
+	if len(requiredAttestations) == 0 {
+		requiredAttestations = defaultPromotionAttestations
+	}
+	predicateTypes := attestationPredicateTypes()
+	for _, name := range requiredAttestations {
+		if _, ok := predicateTypes[name]; !ok {
+			return nil, fmt.Errorf("invalid attestation %q, expected one of %v", name, slices.Sorted(maps.Keys(predicateTypes)))
+		}
+	}
+
+	sourceRegistry, err := withDockerConfig(ctx, registryTarget{address: source, username: sourceUsername, password: sourcePassword, service: sourceService}, registryConfig)
+	if err != nil {
+		return nil, err
+	}
+	targetRegistry, err := withDockerConfig(ctx, registryTarget{address: target, username: targetUsername, password: targetPassword, service: targetService}, registryConfig)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := m.resolveDigest(ctx, sourceRegistry)
+	if err != nil {
+		return nil, err
+	}
+	name, _ := splitImageAddress(source)
+	sourceRef := name + "@" + digest
+
+	// Only verified images are promoted, the verification outputs are kept as evidence
+	signature, err := m.verifySignature(ctx, verifier, sourceRegistry, sourceRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify the signature of %s: %w", sourceRef, err)
+	}
+	verifications := map[string]string{"verify/signature.json": signature}
+	var verificationsMu sync.Mutex
+	// the SBOMs and vulnerability reports of an image index are attested to the manifest of each platform
+	platforms, err := m.platformDigests(ctx, sourceRegistry, sourceRef)
+	if err != nil {
+		return nil, err
+	}
+	references := platformReferences(name, sourceRef, platforms)
+	err = runAll(ctx, requiredAttestations, func(ctx context.Context, name string) error {
+		attested := []string{sourceRef}
+		if platformAttestation(predicateTypes[name]) {
+			attested = references
+		}
+		output, err := m.verifyAttestations(ctx, verifier, sourceRegistry, attested, predicateTypes[name])
+		if err != nil {
+			return fmt.Errorf("failed to verify the %s attestation of %s: %w", name, sourceRef, err)
+		}
+		verificationsMu.Lock()
+		defer verificationsMu.Unlock()
+		verifications[fmt.Sprintf("verify/attestation-%s.json", name)] = output
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	targetRef, err := m.mirror(ctx, sourceRegistry, sourceRef, targetRegistry)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &PromotionResult{
+		Source:       sourceRef,
+		Target:       targetRef,
+		Digest:       digest,
+		Attestations: requiredAttestations,
+	}
+	record, err := json.MarshalIndent(promotionRecord{
+		Version:      promotionVersion,
+		Source:       result.Source,
+		Target:       result.Target,
+		Digest:       result.Digest,
+		SigningMode:  verifier.mode,
+		Attestations: result.Attestations,
+		PromotedAt:   time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	directory := dag.Directory()
+	for _, path := range slices.Sorted(maps.Keys(verifications)) {
+		directory = directory.WithNewFile(path, verifications[path])
+	}
+	result.Directory = directory.WithNewFile("promotion.json", string(record))
+	result.Record = result.Directory.File("promotion.json")
+
+	return result, nil
+}
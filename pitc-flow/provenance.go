@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cosign attestation predicate type of SLSA v1 provenance
+const provenancePredicateType = "slsaprovenance1"
+
+// Builder and build type of the SLSA provenance
+const (
+	provenanceBuilderID = "https://github.com/puzzle/dagger-module-pitc-flow"
+	provenanceBuildType = "https://github.com/puzzle/dagger-module-pitc-flow/docker-build@v1"
+)
+
+// Tool images used by the pipeline run, each function call runs in its own process of the module
+var usedTools = struct {
+	sync.Mutex
+	// containers of the tool images by image
+	containers map[string]*dagger.Container
+}{containers: map[string]*dagger.Container{}}
+
+// Returns a container of the tool image and records the use of the tool for the provenance,
+// the tool is always run from the same container to resolve the digest it actually ran with
+func toolContainer(image string) *dagger.Container {
+	usedTools.Lock()
+	defer usedTools.Unlock()
+	container, ok := usedTools.containers[image]
+	if !ok {
+		container = dag.Container().From(image)
+		usedTools.containers[image] = container
+	}
+	return container
+}
+
+// Returns the containers of the tool images used so far by the pipeline run, by image
+func usedToolContainers() map[string]*dagger.Container {
+	usedTools.Lock()
+	defer usedTools.Unlock()
+	return maps.Clone(usedTools.containers)
+}
+
+// The build of the app container described by the provenance
+type buildProvenance struct {
+	// source directory the image is built from
+	dir *dagger.Directory
+	// build options
+	opts buildOptions
+}
+
+// SLSA v1 provenance predicate, see https://slsa.dev/spec/v1.0/provenance
+type slsaProvenance struct {
+	BuildDefinition struct {
+		BuildType            string                   `json:"buildType"`
+		ExternalParameters   slsaExternalParameters   `json:"externalParameters"`
+		ResolvedDependencies []slsaResourceDescriptor `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID      string            `json:"id"`
+			Version map[string]string `json:"version,omitempty"`
+		} `json:"builder"`
+		Metadata struct {
+			StartedOn  time.Time `json:"startedOn"`
+			FinishedOn time.Time `json:"finishedOn"`
+		} `json:"metadata"`
+	} `json:"runDetails"`
+}
+
+// Parameters of the build provided by the caller of the pipeline
+type slsaExternalParameters struct {
+	Dockerfile string            `json:"dockerfile"`
+	Target     string            `json:"target,omitempty"`
+	BuildArgs  map[string]string `json:"buildArgs,omitempty"`
+	Platforms  []string          `json:"platforms,omitempty"`
+}
+
+// An artifact the build depends on, identified by its digest
+type slsaResourceDescriptor struct {
+	URI    string            `json:"uri,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Creates the SLSA v1 provenance predicate of the build which ran within the provided time frame
+func (m *PitcFlow) provenance(
+	ctx context.Context,
+	// build described by the provenance
+	build *buildProvenance,
+	// containers of the tool images used by the pipeline run, by image
+	tools map[string]*dagger.Container,
+	// start time of the build
+	startedAt time.Time,
+	// end time of the build
+	finishedAt time.Time,
+) (string, error) {
+	dockerfile := build.opts.dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+
+	var predicate slsaProvenance
+	predicate.BuildDefinition.BuildType = provenanceBuildType
+	predicate.BuildDefinition.ExternalParameters = slsaExternalParameters{
+		Dockerfile: dockerfile,
+		Target:     build.opts.target,
+	}
+	for _, arg := range build.opts.args {
+		if predicate.BuildDefinition.ExternalParameters.BuildArgs == nil {
+			predicate.BuildDefinition.ExternalParameters.BuildArgs = map[string]string{}
+		}
+		predicate.BuildDefinition.ExternalParameters.BuildArgs[arg.Name] = arg.Value
+	}
+	for _, platform := range build.opts.platforms {
+		predicate.BuildDefinition.ExternalParameters.Platforms = append(predicate.BuildDefinition.ExternalParameters.Platforms, string(platform))
+	}
+
+	sourceDigest, err := build.dir.Digest(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the digest of the source directory: %w", err)
+	}
+	dockerfileDigest, err := build.dir.File(dockerfile).Digest(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the digest of the Dockerfile: %w", err)
+	}
+	predicate.BuildDefinition.ResolvedDependencies = []slsaResourceDescriptor{
+		{Name: "source", Digest: digestSet(sourceDigest)},
+		{Name: dockerfile, Digest: digestSet(dockerfileDigest)},
+	}
+	for _, image := range slices.Sorted(maps.Keys(tools)) {
+		ref, err := tools[image].ImageRef(ctx)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve the tool image %s: %w", image, err)
+		}
+		_, digest, _ := strings.Cut(ref, "@")
+		predicate.BuildDefinition.ResolvedDependencies = append(predicate.BuildDefinition.ResolvedDependencies,
+			slsaResourceDescriptor{URI: "docker://" + image, Digest: digestSet(digest)})
+	}
+
+	// the module is identified by the digest of its source as it is not aware of its own version
+	moduleDigest, err := dag.CurrentModule().Source().Digest(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the digest of the module: %w", err)
+	}
+	predicate.RunDetails.Builder.ID = provenanceBuilderID
+	predicate.RunDetails.Builder.Version = map[string]string{"pitc-flow": moduleDigest}
+	predicate.RunDetails.Metadata.StartedOn = startedAt.UTC()
+	predicate.RunDetails.Metadata.FinishedOn = finishedAt.UTC()
+
+	content, err := json.MarshalIndent(predicate, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
+
+// Converts a digest e.g. "sha256:abc" into an in-toto digest set
+func digestSet(digest string) map[string]string {
+	algorithm, value, found := strings.Cut(digest, ":")
+	if !found {
+		return map[string]string{"sha256": digest}
+	}
+	return map[string]string{algorithm: value}
+}
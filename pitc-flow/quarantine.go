@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Quarantine repository the image is published to before it is released to its registry address
+type quarantine struct {
+	// repository registry/repository/image without tag
+	repository string
+}
+
+// Creates the quarantine, returns nil if the image is published to its registry address directly,
+// the quarantine repository must be on the registry of the registry address as it is accessed with its credentials
+func newQuarantine(repository string, registryAddress string) (*quarantine, error) {
+	if repository == "" {
+		return nil, nil
+	}
+	if strings.Contains(repository, "@") || strings.LastIndex(repository, ":") > strings.LastIndex(repository, "/") {
+		return nil, fmt.Errorf("invalid quarantine repository %q, expected registry/repository/image without tag or digest", repository)
+	}
+	if registryAddress != "" && registryHost(repository) != registryHost(registryAddress) {
+		return nil, fmt.Errorf("the quarantine repository %q must be on the registry %s of the registry address", repository, registryHost(registryAddress))
+	}
+	return &quarantine{repository: repository}, nil
+}
+
+// Returns the quarantine address of the image, it has the tag of the registry address
+func (q *quarantine) address(registryAddress string) string {
+	_, tag := splitImageAddress(registryAddress)
+	return q.repository + ":" + tag
+}
+
+// Returns the tag marking a quarantined image as rejected e.g. "1.4.2-rejected"
+func (q *quarantine) rejectedTag(registryAddress string) string {
+	_, tag := splitImageAddress(registryAddress)
+	return tag + "-rejected"
+}
+
+// Releases the quarantined image with its signatures and attestations to the registry address and returns its reference
+// e.g. "registry/repository/image:tag@sha256:abc"
+func (m *PitcFlow) release(
+	ctx context.Context,
+	// quarantine registry
+	source registryTarget,
+	// quarantined image reference with digest
+	digest string,
+	// registry the image is released to, its address contains the primary tag
+	target registryTarget,
+	// additional tags of the released image
+	tags []string,
+) (string, error) {
+	reference, err := m.mirror(ctx, source, digest, target)
+	if err != nil {
+		return "", err
+	}
+	if err := m.tagImage(ctx, target, reference, tags); err != nil {
+		return "", err
+	}
+	return target.address + "@" + referenceDigest(reference), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Image inspecting and copying images in registries
+const craneImage = "cgr.dev/chainguard/crane:latest-dev"
+
+// A registry the image is published to
+type registryTarget struct {
+	// image address registry/repository/image:tag
+	address string
+	// username of the registry's account
+	username string
+	// API key, password or token to authenticate to the registry
+	password *dagger.Secret
+	// service bound to the host of the address e.g. a local registry
+	service *dagger.Service
+}
+
+// Content of a docker config.json file, only the static credentials are supported
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+}
+
+// Returns the registry target with the credentials of its host from the docker config.json, if it has no password,
+// without an entry for the host the registry is accessed anonymously
+func withDockerConfig(ctx context.Context, registry registryTarget, config *dagger.Secret) (registryTarget, error) {
+	if config == nil || registry.password != nil {
+		return registry, nil
+	}
+	content, err := config.Plaintext(ctx)
+	if err != nil {
+		return registry, err
+	}
+	var parsed dockerConfig
+	if err := json.Unmarshal([]byte(content), &parsed); err != nil {
+		return registry, fmt.Errorf("failed to parse the docker config.json: %w", err)
+	}
+	host := registryHost(registry.address)
+	for server, auth := range parsed.Auths {
+		if configHost(server) != host {
+			continue
+		}
+		if auth.IdentityToken != "" {
+			return registry, fmt.Errorf("the identity token of %s in the docker config.json is not supported", server)
+		}
+		username, password := auth.Username, auth.Password
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return registry, fmt.Errorf("invalid auth of %s in the docker config.json: %w", server, err)
+			}
+			username, password, _ = strings.Cut(string(decoded), ":")
+		}
+		registry.username = username
+		registry.password = dag.SetSecret("registry-config-"+host, password)
+		return registry, nil
+	}
+	return registry, nil
+}
+
+// Returns the registry host of a docker config.json server e.g. "https://index.docker.io/v1/" is "docker.io"
+func configHost(server string) string {
+	if _, rest, found := strings.Cut(server, "://"); found {
+		server = rest
+	}
+	host, _, _ := strings.Cut(server, "/")
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return host
+}
+
+// Returns a container executing cosign with the authentication to the registries, the arguments of WithExec
+// are passed to cosign
+func cosignContainer(registries ...registryTarget) *dagger.Container {
+	return registryContainer(cosignImage, "cosign", "login", registries...)
+}
+
+// Returns a container executing crane with the authentication to the registries, the arguments of WithExec
+// are passed to crane
+func craneContainer(registries ...registryTarget) *dagger.Container {
+	return registryContainer(craneImage, "crane", "auth login", registries...)
+}
+
+// Returns a container executing the registry tool with the authentication to the registries
+func registryContainer(
+	// image containing the tool and a shell
+	image string,
+	// name of the tool's executable
+	tool string,
+	// sub command of the tool logging in to a registry
+	login string,
+	// registries to log in to
+	registries ...registryTarget,
+) *dagger.Container {
+	container := toolContainer(image).
+		WithEnvVariable("REGISTRY_LOGIN", login).
+		WithEnvVariable("REGISTRY_COUNT", strconv.Itoa(len(registries)))
+	for i, registry := range registries {
+		container = container.
+			WithEnvVariable(fmt.Sprintf("REGISTRY_HOST_%d", i), registryHost(registry.address)).
+			WithEnvVariable(fmt.Sprintf("REGISTRY_USERNAME_%d", i), registry.username)
+		if registry.password != nil {
+			container = container.WithSecretVariable(fmt.Sprintf("REGISTRY_PASSWORD_%d", i), registry.password)
+		}
+		if registry.service != nil {
+			host, _, _ := strings.Cut(registryHost(registry.address), ":")
+			container = container.WithServiceBinding(host, registry.service)
+		}
+	}
+	// the credentials are only ever passed as secret variables and expanded by the shell
+	script := `set -e
+i=0
+while [ "$i" -lt "${REGISTRY_COUNT}" ]; do
+  eval "host=\${REGISTRY_HOST_$i} username=\${REGISTRY_USERNAME_$i} password=\${REGISTRY_PASSWORD_$i:-}"
+  if [ -n "${password}" ]; then
+    echo "${password}" | "$0" ${REGISTRY_LOGIN} "${host}" -u "${username}" --password-stdin
+  fi
+  i=$((i + 1))
+done
+exec "$0" "$@"`
+	return container.WithEntrypoint([]string{"sh", "-c", script, tool})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Image computing the digests of the report files
+const busyboxImage = "busybox"
+
+// cosign attestation predicate types of the reports by step
+var reportPredicateTypes = map[string]string{
+	"lint":              provenanceBuilderID + "/attestations/lint/v1",
+	"sast":              provenanceBuilderID + "/attestations/sast/v1",
+	"unit-tests":        provenanceBuilderID + "/attestations/unit-tests/v1",
+	"integration-tests": provenanceBuilderID + "/attestations/integration-tests/v1",
+}
+
+// Predicate binding the reports of a step to the image
+type reportPredicate struct {
+	// name of the step e.g. "lint"
+	Step string `json:"step"`
+	// builder which ran the step
+	Builder string `json:"builder"`
+	// report files with their digests
+	Reports []slsaResourceDescriptor `json:"reports"`
+}
+
+// Packages the report directory of the step into a predicate listing the digests of all its files
+func (m *PitcFlow) reportPredicate(
+	ctx context.Context,
+	// name of the step e.g. "lint"
+	step string,
+	// report directory of the step
+	reports *dagger.Directory,
+) (*dagger.File, error) {
+	// the records "<digest> <path>" are separated by NUL as the paths may contain spaces and newlines
+	script := `find . -type f -print0 | sort -z | xargs -0 -r sh -c 'for f; do printf "%s %s\0" "$(sha256sum < "$f" | cut -d " " -f 1)" "$f"; done' sh`
+	checksums, err := toolContainer(busyboxImage).
+		WithDirectory("/reports", reports).
+		WithWorkdir("/reports").
+		WithExec([]string{"sh", "-c", script}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute the digests of the %s reports: %w", step, err)
+	}
+
+	predicate := reportPredicate{Step: step, Builder: provenanceBuilderID, Reports: []slsaResourceDescriptor{}}
+	for _, record := range strings.Split(checksums, "\x00") {
+		digest, path, found := strings.Cut(record, " ")
+		if !found {
+			continue
+		}
+		predicate.Reports = append(predicate.Reports, slsaResourceDescriptor{
+			Name:   strings.TrimPrefix(path, "./"),
+			Digest: map[string]string{"sha256": digest},
+		})
+	}
+
+	content, err := json.MarshalIndent(predicate, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return dag.Directory().WithNewFile(step+".json", string(content)).File(step + ".json"), nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"dagger/pitc-flow/internal/dagger"
+	"encoding/json"
+	"time"
+)
+
+// Version of the status.json format
+const statusVersion = 1
+
+// States of a pipeline step
+const (
+	statusPassed     = "passed"
+	statusFailed     = "failed"
+	statusSoftFailed = "soft-failed"
+	statusSkipped    = "skipped"
+)
+
+// The result of a single pipeline step
+type StepResult struct {
+	// name of the step e.g. "lint"
+	Name string `json:"name"`
+	// status of the step: passed, failed, soft-failed or skipped
+	Status string `json:"status"`
+	// start time of the step (RFC 3339)
+	StartedAt string `json:"startedAt,omitempty"`
+	// end time of the step (RFC 3339)
+	FinishedAt string `json:"finishedAt,omitempty"`
+	// duration of the step e.g. "1m2.5s"
+	Duration string `json:"duration,omitempty"`
+	// error message of a failed step
+	Error string `json:"error,omitempty"`
+	// artifacts produced by the step, paths within the results directory or image references
+	Artifacts []string `json:"artifacts,omitempty"`
+}
+
+// Content of the status.json file
+type pipelineStatus struct {
+	Version   int           `json:"version"`
+	Succeeded bool          `json:"succeeded"`
+	Steps     []*StepResult `json:"steps"`
+}
+
+// A platform variant of the app container image
+type ImageVariant struct {
+	// platform of the variant e.g. "linux/arm64", empty for a single platform image
+	Platform string
+	// SBOM of the variant in the first selected format
+	Sbom *dagger.File
+	// SBOMs of the variant in all the selected formats
+	Sboms []*dagger.File
+	// CycloneDX SBOM of the variant merged with the source SBOM
+	MergedSbom *dagger.File
+	// vulnerability scan report of the variant
+	VulnReport *dagger.File
+	// digest of the variant's image manifest once published
+	Digest string
+}
+
+// The result of a pipeline run
+type PipelineResult struct {
+	// directory containing all the results
+	Directory *dagger.Directory
+	// directory containing the lint, security scan and test reports
+	Reports *dagger.Directory
+	// SBOM of the image in the first selected format (first platform variant)
+	Sbom *dagger.File
+	// SBOMs of the source directory in all the selected formats
+	SourceSboms []*dagger.File
+	// vulnerability scan report (first platform variant)
+	VulnReport *dagger.File
+	// results of the platform variants of the image
+	Variants []*ImageVariant
+	// digest of the published image e.g. "sha256:abc", empty if the image was not published
+	ImageDigest string
+	// fully qualified reference of the published image by digest e.g. "registry/repository/image@sha256:abc"
+	ImageRef string
+	// tags the image was published with
+	Tags []string
+	// references of the image copies in the mirrors
+	Mirrors []string
+	// reference of the image in the quarantine repository with tag and digest, empty if not quarantined
+	QuarantineRef string
+	// machine-readable status.json of the run
+	Status *dagger.File
+	// results of all the pipeline steps
+	Steps []*StepResult
+}
+
+// Returns true if none of the pipeline steps failed
+func (r *PipelineResult) Succeeded() bool {
+	return succeeded(r.Steps)
+}
+
+// Returns true if none of the provided steps failed, soft failures are ignored
+func succeeded(steps []*StepResult) bool {
+	for _, s := range steps {
+		if s.Status == statusFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// Converts the step outcomes into step results
+func stepResults(
+	outcomes []stepOutcome,
+	// artifacts produced by the steps, by step name, failed steps keep the artifacts they produced e.g. findings
+	artifacts map[string][]string,
+) []*StepResult {
+	results := make([]*StepResult, 0, len(outcomes))
+	for _, outcome := range outcomes {
+		result := &StepResult{Name: outcome.name, Status: statusSkipped}
+		if !outcome.skipped {
+			result.Status = statusPassed
+			result.StartedAt = outcome.startedAt.UTC().Format(time.RFC3339Nano)
+			result.FinishedAt = outcome.startedAt.Add(outcome.duration).UTC().Format(time.RFC3339Nano)
+			result.Duration = outcome.duration.String()
+			result.Artifacts = artifacts[outcome.name]
+		}
+		if outcome.err != nil {
+			result.Status = statusFailed
+			if outcome.soft {
+				result.Status = statusSoftFailed
+			}
+			result.Error = outcome.err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Returns the content of the status.json file for the provided steps
+func statusJSON(steps []*StepResult) (string, error) {
+	content, err := json.MarshalIndent(pipelineStatus{
+		Version:   statusVersion,
+		Succeeded: succeeded(steps),
+		Steps:     steps,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"dagger/pitc-flow/internal/dagger"
+	"fmt"
+	"net/url"
+)
+
+// Signing modes for image signatures and attestations
+const (
+	// Fulcio certificates and Rekor transparency log
+	signingKeyless = "keyless"
+	// cosign private key
+	signingKey = "key"
+	// key managed by a KMS e.g. Hashicorp Vault transit
+	signingKMS = "kms"
+)
+
+// Cosign image used for signing with keys, contains a shell to pass the credentials as secrets
+const cosignImage = "cgr.dev/chainguard/cosign:latest-dev"
+
+// Configuration for signing images and attestations
+type signer struct {
+	// signing mode: keyless, key or kms
+	mode string
+	// cosign private key (key)
+	privateKey *dagger.Secret
+	// password of the cosign private key (key)
+	password *dagger.Secret
+	// KMS key URI e.g. "hashivault://cosign" (kms)
+	kmsKey string
+	// Hashicorp Vault address (kms)
+	vaultAddress string
+	// Hashicorp Vault token (kms)
+	vaultToken *dagger.Secret
+	// Hashicorp Vault service bound to the host of the Vault address (kms)
+	vaultService *dagger.Service
+	// cosign public key, derived from the private key if nil (key)
+	publicKey *dagger.File
+	// expected identity of the signing certificate as regular expression (keyless)
+	certificateIdentity string
+	// expected OIDC issuer of the signing certificate (keyless)
+	certificateOidcIssuer string
+}
+
+// Creates the signing configuration, the mode defaults to keyless
+func newSigner(
+	mode string,
+	privateKey *dagger.Secret,
+	password *dagger.Secret,
+	kmsKey string,
+	vaultAddress string,
+	vaultToken *dagger.Secret,
+	vaultService *dagger.Service,
+	publicKey *dagger.File,
+	certificateIdentity string,
+	certificateOidcIssuer string,
+	// the image is published, its signature must be verifiable
+	publishing bool,
+) (*signer, error) {
+	s := &signer{
+		mode:                  mode,
+		privateKey:            privateKey,
+		password:              password,
+		kmsKey:                kmsKey,
+		vaultAddress:          vaultAddress,
+		vaultToken:            vaultToken,
+		vaultService:          vaultService,
+		publicKey:             publicKey,
+		certificateIdentity:   certificateIdentity,
+		certificateOidcIssuer: certificateOidcIssuer,
+	}
+	switch mode {
+	case "", signingKeyless:
+		s.mode = signingKeyless
+		if (certificateIdentity == "") != (certificateOidcIssuer == "") {
+			return nil, fmt.Errorf("the verification of keyless signatures requires both the certificate identity and OIDC issuer")
+		}
+		if publishing && certificateIdentity == "" {
+			return nil, fmt.Errorf("publishing with keyless signing requires the certificate identity and OIDC issuer to verify the signature")
+		}
+	case signingKey:
+		if privateKey == nil {
+			return nil, fmt.Errorf("the signing mode %q requires a cosign private key", mode)
+		}
+	case signingKMS:
+		if kmsKey == "" {
+			return nil, fmt.Errorf("the signing mode %q requires a KMS key URI", mode)
+		}
+	default:
+		return nil, fmt.Errorf("invalid signing mode %q, expected %q, %q or %q", mode, signingKeyless, signingKey, signingKMS)
+	}
+	return s, nil
+}
+
+// Returns the key reference passed to cosign with --key
+func (s *signer) keyRef() string {
+	if s.mode == signingKMS {
+		return s.kmsKey
+	}
+	return "/cosign/cosign.key"
+}
+
+// Returns a container executing cosign with the signing key and the authentication to the registry of the image,
+// the arguments of WithExec are passed to cosign
+func (s *signer) cosign(
+	// image reference, its registry is logged in to
+	image string,
+	// Username of the registry's account
+	registryUsername string,
+	// API key, password or token to authenticate to the registry
+	registryPassword *dagger.Secret,
+) (*dagger.Container, error) {
+	return s.withKey(cosignContainer(registryTarget{address: image, username: registryUsername, password: registryPassword}))
+}
+
+// Adds the signing key to the cosign container, a verifier only has the public key
+func (s *signer) withKey(container *dagger.Container) (*dagger.Container, error) {
+	switch s.mode {
+	case signingKey:
+		if s.privateKey == nil {
+			break
+		}
+		container = container.WithMountedSecret("/cosign/cosign.key", s.privateKey)
+		if s.password != nil {
+			container = container.WithSecretVariable("COSIGN_PASSWORD", s.password)
+		} else {
+			container = container.WithEnvVariable("COSIGN_PASSWORD", "")
+		}
+	case signingKMS:
+		if s.vaultAddress != "" {
+			container = container.WithEnvVariable("VAULT_ADDR", s.vaultAddress)
+		}
+		if s.vaultToken != nil {
+			container = container.WithSecretVariable("VAULT_TOKEN", s.vaultToken)
+		}
+		if s.vaultService != nil {
+			vaultURL, err := url.Parse(s.vaultAddress)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Vault address %q: %w", s.vaultAddress, err)
+			}
+			container = container.WithServiceBinding(vaultURL.Hostname(), s.vaultService)
+		}
+	}
+	return container, nil
+}
+
+// Returns a container executing cosign like cosign() and the arguments selecting the expected signer for
+// verify and verify-attestation
+func (s *signer) verifier(
+	// registry of the image, it is logged in to
+	registry registryTarget,
+) (*dagger.Container, []string, error) {
+	container, err := s.withKey(cosignContainer(registry))
+	if err != nil {
+		return nil, nil, err
+	}
+	var args []string
+	switch s.mode {
+	case signingKey:
+		if s.publicKey != nil {
+			container = container.WithFile("/tmp/cosign.pub", s.publicKey)
+		} else {
+			container = container.WithExec([]string{"public-key", "--key", s.keyRef(), "--outfile", "/tmp/cosign.pub"}, dagger.ContainerWithExecOpts{UseEntrypoint: true})
+		}
+		// signatures with keys are not uploaded to the transparency log
+		args = []string{"--key", "/tmp/cosign.pub", "--insecure-ignore-tlog=true"}
+	case signingKMS:
+		args = []string{"--key", s.keyRef(), "--insecure-ignore-tlog=true"}
+	default:
+		args = []string{"--certificate-identity-regexp", s.certificateIdentity, "--certificate-oidc-issuer", s.certificateOidcIssuer}
+	}
+	// local registries bound as services are only reachable over plain HTTP
+	if registry.service != nil {
+		args = append(args, "--allow-http-registry")
+	}
+	return container, args, nil
+}
+
+// Creates the configuration for verifying signatures and attestations without the signing key
+func newVerifier(
+	mode string,
+	publicKey *dagger.File,
+	kmsKey string,
+	vaultAddress string,
+	vaultToken *dagger.Secret,
+	vaultService *dagger.Service,
+	certificateIdentity string,
+	certificateOidcIssuer string,
+) (*signer, error) {
+	s := &signer{
+		mode:                  mode,
+		publicKey:             publicKey,
+		kmsKey:                kmsKey,
+		vaultAddress:          vaultAddress,
+		vaultToken:            vaultToken,
+		vaultService:          vaultService,
+		certificateIdentity:   certificateIdentity,
+		certificateOidcIssuer: certificateOidcIssuer,
+	}
+	switch mode {
+	case "", signingKeyless:
+		s.mode = signingKeyless
+		if certificateIdentity == "" || certificateOidcIssuer == "" {
+			return nil, fmt.Errorf("the verification of keyless signatures requires the certificate identity and OIDC issuer")
+		}
+	case signingKey:
+		if publicKey == nil {
+			return nil, fmt.Errorf("the verification of the signing mode %q requires a cosign public key", mode)
+		}
+	case signingKMS:
+		if kmsKey == "" {
+			return nil, fmt.Errorf("the signing mode %q requires a KMS key URI", mode)
+		}
+	default:
+		return nil, fmt.Errorf("invalid signing mode %q, expected %q, %q or %q", mode, signingKeyless, signingKey, signingKMS)
+	}
+	return s, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Tags which may be overwritten by default despite the tag protection
+var defaultMutableTags = []string{"latest"}
+
+// Protection of the published tags against being overwritten with a different digest
+type tagProtection struct {
+	// tags which may be overwritten
+	mutableTags []string
+}
+
+// Creates the tag protection, returns nil if the protection is disabled
+func newTagProtection(enabled bool, mutableTags []string) *tagProtection {
+	if !enabled {
+		return nil
+	}
+	if len(mutableTags) == 0 {
+		mutableTags = defaultMutableTags
+	}
+	return &tagProtection{mutableTags: mutableTags}
+}
+
+// Returns the protection which additionally allows overwriting the tags e.g. the floating tags "1.4" and "1" of a release
+func (p *tagProtection) allowing(tags []string) *tagProtection {
+	return &tagProtection{mutableTags: append(slices.Clone(p.mutableTags), tags...)}
+}
+
+// Returns the digest the tag currently points to, empty if the tag does not exist
+func (m *PitcFlow) existingDigest(ctx context.Context, registry registryTarget) (string, error) {
+	args := []string{"digest"}
+	if registry.service != nil {
+		args = append(args, "--insecure")
+	}
+	container, err := craneContainer(registry).
+		WithExec(append(args, registry.address), dagger.ContainerWithExecOpts{UseEntrypoint: true, Expect: dagger.ReturnTypeAny}).
+		Sync(ctx)
+	if err != nil {
+		return "", err
+	}
+	exitCode, err := container.ExitCode(ctx)
+	if err != nil {
+		return "", err
+	}
+	if exitCode == 0 {
+		digest, err := container.Stdout(ctx)
+		return strings.TrimSpace(digest), err
+	}
+	stderr, err := container.Stderr(ctx)
+	if err != nil {
+		return "", err
+	}
+	// only the registry error codes of a missing tag or repository mean the tag does not exist,
+	// any other failure must not pass the protection
+	if strings.Contains(stderr, "MANIFEST_UNKNOWN") || strings.Contains(stderr, "NAME_UNKNOWN") {
+		return "", nil
+	}
+	return "", fmt.Errorf("failed to resolve the tag %s: %s", registry.address, strings.TrimSpace(stderr))
+}
+
+// Returns the digest the containers get once published, it is read from the OCI tarball which contains the same manifest
+func (m *PitcFlow) localDigest(ctx context.Context, containers []*dagger.Container) (string, error) {
+	container := containers[0]
+	var opts dagger.ContainerAsTarballOpts
+	if len(containers) > 1 {
+		container = dag.Container()
+		opts.PlatformVariants = containers
+	}
+	content, err := toolContainer(busyboxImage).
+		WithMountedFile("/tmp/image.tar", container.AsTarball(opts)).
+		WithExec([]string{"tar", "-xOf", "/tmp/image.tar", "index.json"}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the manifest of the image: %w", err)
+	}
+	var index struct {
+		Manifests []struct {
+			Digest string `json:"digest"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal([]byte(content), &index); err != nil || len(index.Manifests) == 0 {
+		return "", fmt.Errorf("failed to parse the manifest of the image: %s", content)
+	}
+	return index.Manifests[0].Digest, nil
+}
+
+// Returns the digest of an already published image reference with digest
+func publishedDigest(reference string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		return referenceDigest(reference), nil
+	}
+}
+
+// Returns an error if one of the protected tags already exists with another digest than the one of the image,
+// re-running the pipeline with the same digest is allowed
+func (m *PitcFlow) checkTags(
+	ctx context.Context,
+	// tag protection
+	protection *tagProtection,
+	// registry of the image, its address is the primary tag
+	registry registryTarget,
+	// additional tags
+	tags []string,
+	// resolves the digest the tags are going to point to, only if one of the protected tags exists
+	imageDigest func(context.Context) (string, error),
+) error {
+	name, primary := splitImageAddress(registry.address)
+	var protected []string
+	for _, tag := range append([]string{primary}, tags...) {
+		if !slices.Contains(protection.mutableTags, tag) {
+			protected = append(protected, tag)
+		}
+	}
+
+	existing := map[string]string{}
+	for _, tag := range protected {
+		target := registry
+		target.address = name + ":" + tag
+		digest, err := m.existingDigest(ctx, target)
+		if err != nil {
+			return err
+		}
+		if digest != "" {
+			existing[tag] = digest
+		}
+	}
+	if len(existing) == 0 {
+		return nil
+	}
+
+	digest, err := imageDigest(ctx)
+	if err != nil {
+		return err
+	}
+	var overwritten []string
+	for _, tag := range protected {
+		if existing[tag] != "" && existing[tag] != digest {
+			overwritten = append(overwritten, fmt.Sprintf("%s:%s (%s)", name, tag, existing[tag]))
+		}
+	}
+	if len(overwritten) > 0 {
+		return fmt.Errorf("refusing to overwrite the existing tags %s with the digest %s", strings.Join(overwritten, ", "), digest)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Image reading the git metadata of the source directory
+const gitImage = "alpine/git"
+
+// Matches valid image tags
+var tagPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+// Matches release versions e.g. "v1.4.2", pre-releases and builds are not matched
+var releasePattern = regexp.MustCompile(`^v?(\d+)\.(\d+)\.(\d+)$`)
+
+// Validates the additional tags of the published image
+func newImageTags(tags []string) ([]string, error) {
+	for _, tag := range tags {
+		if !tagPattern.MatchString(tag) {
+			return nil, fmt.Errorf("invalid image tag %q", tag)
+		}
+	}
+	return tags, nil
+}
+
+// Derives the image tags and the floating ones among them from the git tags and the commit SHA of HEAD in the source directory
+func (m *PitcFlow) gitTags(ctx context.Context, dir *dagger.Directory) ([]string, []string, error) {
+	// the first line is the short commit SHA, the following lines are the git tags of the commit
+	output, err := toolContainer(gitImage).
+		WithDirectory("/src", dir).
+		WithWorkdir("/src").
+		WithExec([]string{"sh", "-c", "git config --global --add safe.directory /src && git rev-parse --short HEAD && git tag --points-at HEAD"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the git metadata of the source directory: %w", err)
+	}
+	lines := strings.Fields(output)
+	if len(lines) == 0 {
+		return nil, nil, fmt.Errorf("failed to read the commit SHA of the source directory")
+	}
+	tags, floating := deriveTags(lines[0], lines[1:])
+	return tags, floating, nil
+}
+
+// Derives the image tags from the commit SHA and its git tags e.g. "v1.4.2" becomes "1.4.2", "1.4" and "1",
+// the floating tags "1.4" and "1" are returned as well as they move on with each release
+func deriveTags(sha string, gitTags []string) ([]string, []string) {
+	var tags []string
+	var floating []string
+	for _, gitTag := range gitTags {
+		if match := releasePattern.FindStringSubmatch(gitTag); match != nil {
+			tags = append(tags, match[1]+"."+match[2]+"."+match[3], match[1]+"."+match[2], match[1])
+			floating = append(floating, match[1]+"."+match[2], match[1])
+			continue
+		}
+		// other tags e.g. pre-releases are only used as they are
+		tag := gitTag
+		if len(tag) > 1 && tag[0] == 'v' && tag[1] >= '0' && tag[1] <= '9' {
+			tag = tag[1:]
+		}
+		if tagPattern.MatchString(tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return append(tags, "sha-"+sha), floating
+}
+
+// Returns the tags without duplicates and without the tag of the registry address, which is always published
+func additionalTags(registryAddress string, tags []string) []string {
+	_, primary := splitImageAddress(registryAddress)
+	var unique []string
+	for _, tag := range tags {
+		if tag != primary && !slices.Contains(unique, tag) {
+			unique = append(unique, tag)
+		}
+	}
+	return unique
+}
+
+// Adds the tags to the image reference with digest
+func (m *PitcFlow) tagImage(
+	ctx context.Context,
+	// registry of the image
+	registry registryTarget,
+	// image reference with digest
+	reference string,
+	// tags to add
+	tags []string,
+) error {
+	return runAll(ctx, tags, func(ctx context.Context, tag string) error {
+		args := []string{"tag"}
+		if registry.service != nil {
+			args = append(args, "--insecure")
+		}
+		_, err := craneContainer(registry).
+			WithExec(append(args, reference, tag), dagger.ContainerWithExecOpts{UseEntrypoint: true}).
+			Sync(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to tag %s with %s: %w", reference, tag, err)
+		}
+		return nil
+	})
+}
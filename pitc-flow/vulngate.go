@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"dagger/pitc-flow/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trivy severities ordered from the lowest to the highest
+var severities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// Configuration of the vulnerability gate
+type vulnerabilityGate struct {
+	// minimum severity failing the gate, empty if only the max counts are checked
+	severity string
+	// only count vulnerabilities which have a fixed version
+	fixableOnly bool
+	// maximum number of allowed vulnerabilities by severity
+	maxCounts map[string]int
+}
+
+// Relevant parts of a Trivy JSON report
+type trivyReport struct {
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID string `json:"VulnerabilityID"`
+			PkgName         string `json:"PkgName"`
+			FixedVersion    string `json:"FixedVersion"`
+			Severity        string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// Creates the vulnerability gate configuration, returns nil if the gate is disabled
+func newVulnerabilityGate(
+	// minimum severity failing the gate e.g. "CRITICAL"
+	severity string,
+	// only count vulnerabilities which have a fixed version
+	fixableOnly bool,
+	// maximum number of allowed vulnerabilities by severity e.g. "HIGH=10"
+	maxCounts []string,
+) (*vulnerabilityGate, error) {
+	if severity == "" && len(maxCounts) == 0 {
+		if fixableOnly {
+			return nil, fmt.Errorf("counting only fixable vulnerabilities requires the vulnerability severity or max counts of the vulnerability gate")
+		}
+		return nil, nil
+	}
+	gate := &vulnerabilityGate{
+		severity:    strings.ToUpper(severity),
+		fixableOnly: fixableOnly,
+		maxCounts:   map[string]int{},
+	}
+	if gate.severity != "" && !slices.Contains(severities, gate.severity) {
+		return nil, fmt.Errorf("invalid vulnerability severity %q, expected one of %v", severity, severities)
+	}
+	for _, maxCount := range maxCounts {
+		name, value, found := strings.Cut(maxCount, "=")
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !found || !slices.Contains(severities, name) {
+			return nil, fmt.Errorf("invalid vulnerability max count %q, expected SEVERITY=COUNT e.g. HIGH=10", maxCount)
+		}
+		count, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("invalid vulnerability max count %q, the count must not be negative", maxCount)
+		}
+		gate.maxCounts[name] = count
+	}
+	return gate, nil
+}
+
+// Evaluates the Trivy JSON report and returns an error with the reason if the gate is exceeded
+func (m *PitcFlow) vulnGate(
+	ctx context.Context,
+	// Trivy JSON report
+	report *dagger.File,
+	// gate configuration
+	gate *vulnerabilityGate,
+) error {
+	content, err := report.Contents(ctx)
+	if err != nil {
+		return err
+	}
+	return gate.evaluate(content)
+}
+
+// Evaluates the content of a Trivy JSON report against the gate
+func (gate *vulnerabilityGate) evaluate(content string) error {
+	var report trivyReport
+	if err := json.Unmarshal([]byte(content), &report); err != nil {
+		return fmt.Errorf("failed to parse the vulnerability report: %w", err)
+	}
+
+	counts := map[string]int{}
+	var blocking []string
+	for _, result := range report.Results {
+		for _, vuln := range result.Vulnerabilities {
+			if gate.fixableOnly && vuln.FixedVersion == "" {
+				continue
+			}
+			severity := strings.ToUpper(vuln.Severity)
+			counts[severity]++
+			if gate.severity != "" && slices.Index(severities, severity) >= slices.Index(severities, gate.severity) {
+				blocking = append(blocking, fmt.Sprintf("%s (%s, %s)", vuln.VulnerabilityID, severity, vuln.PkgName))
+			}
+		}
+	}
+
+	var reasons []string
+	if len(blocking) > 0 {
+		reasons = append(reasons, fmt.Sprintf("%d vulnerabilities with severity %s or higher: %s", len(blocking), gate.severity, strings.Join(blocking, ", ")))
+	}
+	for _, severity := range severities {
+		maxCount, ok := gate.maxCounts[severity]
+		if ok && counts[severity] > maxCount {
+			reasons = append(reasons, fmt.Sprintf("%d %s vulnerabilities exceed the maximum of %d", counts[severity], severity, maxCount))
+		}
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("vulnerability gate failed: %s", strings.Join(reasons, "; "))
+	}
+	return nil
+}
+
+// cosign attestation predicate type of vulnerability scans
+const vulnPredicateType = "vuln"
+
+// cosign vulnerability attestation predicate, see https://github.com/sigstore/cosign/blob/main/specs/COSIGN_VULN_ATTESTATION_SPEC.md
+type cosignVulnPredicate struct {
+	Invocation struct {
+		Parameters any    `json:"parameters"`
+		URI        string `json:"uri"`
+		EventID    string `json:"event_id"`
+		BuilderID  string `json:"builder.id"`
+	} `json:"invocation"`
+	Scanner struct {
+		URI     string `json:"uri"`
+		Version string `json:"version"`
+		DB      struct {
+			URI     string `json:"uri"`
+			Version string `json:"version"`
+		} `json:"db"`
+		Result json.RawMessage `json:"result"`
+	} `json:"scanner"`
+	Metadata struct {
+		ScanStartedOn  time.Time `json:"scanStartedOn"`
+		ScanFinishedOn time.Time `json:"scanFinishedOn"`
+	} `json:"metadata"`
+}
+
+// Wraps the Trivy JSON report of the scan which ran within the provided time frame into a cosign vulnerability predicate
+func (m *PitcFlow) vulnPredicate(
+	ctx context.Context,
+	// Trivy JSON report
+	report *dagger.File,
+	// start time of the scan
+	startedAt time.Time,
+	// end time of the scan
+	finishedAt time.Time,
+) (*dagger.File, error) {
+	content, err := report.Contents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// the version of Trivy is only contained in reports of recent versions
+	var scanner struct {
+		Trivy struct {
+			Version string `json:"Version"`
+		} `json:"Trivy"`
+	}
+	if err := json.Unmarshal([]byte(content), &scanner); err != nil {
+		return nil, fmt.Errorf("failed to parse the vulnerability report: %w", err)
+	}
+
+	var predicate cosignVulnPredicate
+	predicate.Invocation.BuilderID = provenanceBuilderID
+	predicate.Scanner.URI = "pkg:github/aquasecurity/trivy"
+	if scanner.Trivy.Version != "" {
+		predicate.Scanner.URI += "@" + scanner.Trivy.Version
+	}
+	predicate.Scanner.Version = scanner.Trivy.Version
+	predicate.Scanner.DB.URI = trivyDatabaseRepository
+	predicate.Scanner.Result = json.RawMessage(content)
+	predicate.Metadata.ScanStartedOn = startedAt.UTC()
+	predicate.Metadata.ScanFinishedOn = finishedAt.UTC()
+
+	predicateContent, err := json.MarshalIndent(predicate, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return dag.Directory().WithNewFile("vuln.json", string(predicateContent)).File("vuln.json"), nil
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"context"
 	"dagger/tests/internal/dagger"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 
@@ -12,6 +15,12 @@ import (
 
 type Tests struct{}
 
+// Expected signer of keyless signatures, the GitHub Actions workflows of the repository
+const (
+	certificateIdentity   = "^https://github.com/puzzle/dagger-module-pitc-flow/"
+	certificateOidcIssuer = "https://token.actions.githubusercontent.com"
+)
+
 // All executes all tests.
 func (m *Tests) All(ctx context.Context) error {
 	p := pool.New().WithErrors().WithContext(ctx)
@@ -21,22 +30,43 @@ func (m *Tests) All(ctx context.Context) error {
 	p.Go(m.Ci)
 	p.Go(m.Flex)
 	p.Go(m.Verify)
+	p.Go(m.VulnerabilityGate)
+	p.Go(m.BuildOptions)
+	p.Go(m.MultiPlatform)
+	p.Go(m.SbomFormats)
+	p.Go(m.SourceSbom)
+	p.Go(m.DeptrackUpload)
+	p.Go(m.DeptrackProject)
+	p.Go(m.DeptrackGate)
+	p.Go(m.KmsSigning)
+	p.Go(m.KeylessSigning)
+	p.Go(m.KeySigning)
+	p.Go(m.PlatformAttestations)
+	p.Go(m.Provenance)
+	p.Go(m.ReportAttestations)
+	p.Go(m.Tags)
+	p.Go(m.Mirrors)
+	p.Go(m.Promote)
+	p.Go(m.ImageLock)
+	p.Go(m.RegistryConfig)
+	p.Go(m.TagProtection)
+	p.Go(m.Quarantine)
 
 	return p.Wait()
 }
 
 // Full test.
 func (m *Tests) Full(ctx context.Context) error {
-	return m.callFull(ctx, dagger.PitcFlowFullOpts{})
+	return m.callFull(ctx, dagger.PitcFlowFullOpts{CertificateIdentity: certificateIdentity, CertificateOidcIssuer: certificateOidcIssuer, AllowFailure: true})
 }
 
 // Full test with pre-built container.
 func (m *Tests) FullWithPreBuiltContainer(ctx context.Context) error {
-	return m.callFull(ctx, dagger.PitcFlowFullOpts{AppContainer: m.uniqContainer("busybox:glibc", fmt.Sprintf("%d", time.Now().UnixNano()))})
+	return m.callFull(ctx, dagger.PitcFlowFullOpts{AppContainer: m.uniqContainer("busybox:glibc", fmt.Sprintf("%d", time.Now().UnixNano())), CertificateIdentity: certificateIdentity, CertificateOidcIssuer: certificateOidcIssuer, AllowFailure: true})
 }
 
 // Ci test.
-func (m *Tests) Ci(_ context.Context) error {
+func (m *Tests) Ci(ctx context.Context) error {
 	uniqBaseContainer := m.uniqContainer("busybox:glibc", fmt.Sprintf("%d", time.Now().UnixNano()))
 	lintContainer := uniqBaseContainer.
 		WithExec([]string{"sh", "-c", "mkdir -p /tmp/lint"}).
@@ -55,7 +85,7 @@ func (m *Tests) Ci(_ context.Context) error {
 	testReportDir := "/tmp/uTests"
 	integrationTestReportDir := "/tmp/iTests"
 
-	directory := dag.PitcFlow().Ci(
+	result := dag.PitcFlow().Ci(
 		dir,
 		lintContainer,
 		lintReportDir,
@@ -67,22 +97,34 @@ func (m *Tests) Ci(_ context.Context) error {
 		integrationTestReportDir,
 	)
 
-	if directory == nil {
-		return fmt.Errorf("should run the pipeline and return a directory")
+	if result == nil {
+		return fmt.Errorf("should run the pipeline and return a result")
+	}
+
+	succeeded, err := result.Succeeded(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the pipeline status: %w", err)
+	}
+	if !succeeded {
+		return fmt.Errorf("should succeed without publishing")
 	}
 
-	files, err := directory.Entries(context.Background())
+	files, err := result.Directory().Entries(context.Background())
 	if err != nil {
 		return fmt.Errorf("failed to list files in directory: %w", err)
 	}
 
+	if !slices.Contains(files, "sbom/") {
+		return fmt.Errorf("sbom/ was missing from all files: %v", files)
+	}
+
 	for _, file := range files {
-		if strings.Contains(file, "status.txt") {
+		if strings.Contains(file, "status.json") {
 			return nil
 		}
 	}
 
-	return fmt.Errorf("status.txt was missing from all files: %v", files)
+	return fmt.Errorf("status.json was missing from all files: %v", files)
 }
 
 // Flex test.
@@ -99,40 +141,1199 @@ func (m *Tests) Flex(_ context.Context) error {
 	dtAddress := "ttl.sh"
 	dtProjectUUID := "12345678-1234-1234-1234-123456789012"
 
-	directory := dag.PitcFlow().Flex(
+	result := dag.PitcFlow().Flex(
 		dir,
-		dagger.PitcFlowFlexOpts{LintContainer: lintContainer, LintReportDir: lintReportDir, RegistryUsername: registryUsername, RegistryPassword: secret, RegistryAddress: registryAddress, DtAddress: dtAddress, DtProjectUUID: dtProjectUUID, DtAPIKey: secret},
+		dagger.PitcFlowFlexOpts{LintContainer: lintContainer, LintReportDir: lintReportDir, RegistryUsername: registryUsername, RegistryPassword: secret, RegistryAddress: registryAddress, DtAddress: dtAddress, DtProjectUUID: dtProjectUUID, DtAPIKey: secret, CertificateIdentity: certificateIdentity, CertificateOidcIssuer: certificateOidcIssuer, AllowFailure: true},
 	)
 
-	if directory == nil {
-		return fmt.Errorf("should run the pipeline and return a directory")
+	if result == nil {
+		return fmt.Errorf("should run the pipeline and return a result")
 	}
 
-	files, err := directory.Entries(context.Background())
+	files, err := result.Directory().Entries(context.Background())
 	if err != nil {
 		return fmt.Errorf("failed to list files in directory: %w", err)
 	}
 
 	for _, file := range files {
-		if strings.Contains(file, "status.txt") {
+		if strings.Contains(file, "status.json") {
 			return nil
 		}
 	}
 
-	return fmt.Errorf("status.txt was missing from all files: %v", files)
+	return fmt.Errorf("status.json was missing from all files: %v", files)
+}
+
+// BuildOptions test.
+func (m *Tests) BuildOptions(ctx context.Context) error {
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			Dockerfile:   "docker/Dockerfile.prod",
+			BuildTarget:  "runtime",
+			BuildArgs:    []string{"VERSION=1.0.0"},
+			BuildSecrets: []*dagger.Secret{dag.SetSecret("npm-token", "verySecret")},
+		},
+	)
+
+	succeeded, err := result.Succeeded(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the pipeline status: %w", err)
+	}
+	if !succeeded {
+		return fmt.Errorf("should build the runtime target of docker/Dockerfile.prod")
+	}
+
+	return nil
+}
+
+// MultiPlatform test.
+func (m *Tests) MultiPlatform(ctx context.Context) error {
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{Platforms: []string{"linux/amd64", "linux/arm64"}},
+	)
+
+	variants, err := result.Variants(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the image variants: %w", err)
+	}
+	if len(variants) != 2 {
+		return fmt.Errorf("should build one variant for each platform, got %d", len(variants))
+	}
+
+	files, err := result.Directory().Entries(ctx, dagger.DirectoryEntriesOpts{Path: "vuln"})
+	if err != nil {
+		return fmt.Errorf("failed to list files in directory: %w", err)
+	}
+	if !slices.Contains(files, "linux-arm64/") {
+		return fmt.Errorf("linux-arm64/ was missing from the vulnerability reports: %v", files)
+	}
+
+	return nil
+}
+
+// SbomFormats test.
+func (m *Tests) SbomFormats(ctx context.Context) error {
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{SbomFormats: []string{"cyclonedx", "spdx", "CycloneDX"}},
+	)
+
+	files, err := result.Directory().Entries(ctx, dagger.DirectoryEntriesOpts{Path: "sbom"})
+	if err != nil {
+		return fmt.Errorf("failed to list files in directory: %w", err)
+	}
+	// the duplicate format is only created once
+	if !slices.Equal(files, []string{"cyclonedx.json", "spdx.json"}) {
+		return fmt.Errorf("should contain one SBOM for each format, got %v", files)
+	}
+
+	// deptrack only accepts CycloneDX SBOMs
+	_, err = dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			SbomFormats:      []string{"spdx"},
+			DtAddress:        "http://deptrack:8080",
+			DtProjectName:    "pitc-flow-test",
+			DtProjectVersion: "1.0.0",
+			DtAPIKey:         dag.SetSecret("dt-api-key", "verySecret"),
+		},
+	).Succeeded(ctx)
+	if err == nil || !strings.Contains(err.Error(), "requires the cyclonedx SBOM format") {
+		return fmt.Errorf("should refuse to upload a SPDX SBOM to deptrack, got %v", err)
+	}
+
+	return nil
+}
+
+// SourceSbom test.
+func (m *Tests) SourceSbom(ctx context.Context) error {
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{SourceSbom: true, MergeSbom: true},
+	)
+
+	files, err := result.Directory().Entries(ctx, dagger.DirectoryEntriesOpts{Path: "sbom"})
+	if err != nil {
+		return fmt.Errorf("failed to list files in directory: %w", err)
+	}
+	for _, file := range []string{"source/", "cyclonedx.json", "cyclonedx-merged.json"} {
+		if !slices.Contains(files, file) {
+			return fmt.Errorf("%s was missing from the SBOMs: %v", file, files)
+		}
+	}
+
+	return nil
+}
+
+// DeptrackUpload test.
+func (m *Tests) DeptrackUpload(ctx context.Context) error {
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	deptrack := m.deptrackMock(`{"project": "12345678-1234-1234-1234-123456789012"}`)
+	upload := func(apiKey string, dtAllowFailure bool) *dagger.PitcFlowPipelineResult {
+		return dag.PitcFlow().Flex(
+			dir,
+			dagger.PitcFlowFlexOpts{
+				DtAddress:      "http://deptrack:8080",
+				DtProjectUUID:  "12345678-1234-1234-1234-123456789012",
+				DtAPIKey:       dag.SetSecret("dt-api-key-"+apiKey, apiKey),
+				DtService:      deptrack,
+				DtAllowFailure: dtAllowFailure,
+				AllowFailure:   true,
+			},
+		)
+	}
+
+	// the mock only accepts uploads with the API key header
+	result := upload("verySecret", false)
+	status, _, err := m.stepStatus(ctx, result, "deptrack")
+	if err != nil {
+		return err
+	}
+	if status != "passed" {
+		return fmt.Errorf("should upload the SBOM with the API key, got %s", status)
+	}
+	response, err := result.Directory().File("deptrack/bom-upload.json").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("should contain the upload response: %w", err)
+	}
+	if !strings.Contains(response, "token") {
+		return fmt.Errorf("the upload response should contain the processing token, got %s", response)
+	}
+
+	status, stepError, err := m.stepStatus(ctx, upload("wrongKey", false), "deptrack")
+	if err != nil {
+		return err
+	}
+	if status != "failed" || !strings.Contains(stepError, "HTTP 401") {
+		return fmt.Errorf("should fail on the rejected upload, got %s: %s", status, stepError)
+	}
+
+	// a rejected upload only soft fails if it is allowed to fail
+	status, stepError, err = m.stepStatus(ctx, upload("wrongKey", true), "deptrack")
+	if err != nil {
+		return err
+	}
+	if status != "soft-failed" || !strings.Contains(stepError, "HTTP 401") {
+		return fmt.Errorf("should report the allowed failure of the rejected upload, got %s: %s", status, stepError)
+	}
+
+	return nil
+}
+
+// DeptrackProject test.
+func (m *Tests) DeptrackProject(ctx context.Context) error {
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+
+	// the mock rejects uploads which do not identify the project exactly like this
+	deptrack := m.deptrackMock(`{"projectName": "pitc-flow-test", "projectVersion": "2.0.0", "autoCreate": true, "parentName": "pitc-flow", "projectTags": [{"name": "team-a"}, {"name": "release"}]}`)
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			DtAddress:        "http://deptrack:8080",
+			DtProjectName:    "pitc-flow-test",
+			DtProjectVersion: "2.0.0",
+			DtParentProject:  "pitc-flow",
+			DtProjectTags:    []string{"team-a", "release"},
+			DtAutoCreate:     true,
+			DtAPIKey:         dag.SetSecret("dt-api-key", "verySecret"),
+			DtService:        deptrack,
+			AllowFailure:     true,
+		},
+	)
+	status, stepError, err := m.stepStatus(ctx, result, "deptrack")
+	if err != nil {
+		return err
+	}
+	if status != "passed" {
+		return fmt.Errorf("should upload the SBOM to the project with its parent and tags, got %s: %s", status, stepError)
+	}
+
+	// the version cannot be derived without publishing the image
+	_, err = dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			DtAddress:     "http://deptrack:8080",
+			DtProjectName: "pitc-flow-test",
+			DtAPIKey:      dag.SetSecret("dt-api-key", "verySecret"),
+			DtService:     deptrack,
+		},
+	).Succeeded(ctx)
+	if err == nil || !strings.Contains(err.Error(), "requires a version") {
+		return fmt.Errorf("should require the project version if the image is not published, got %v", err)
+	}
+
+	return nil
+}
+
+// DeptrackGate test.
+func (m *Tests) DeptrackGate(ctx context.Context) error {
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			DtAddress:        "http://deptrack:8080",
+			DtProjectName:    "pitc-flow-test",
+			DtProjectVersion: "1.0.0",
+			DtAutoCreate:     true,
+			DtAPIKey:         dag.SetSecret("dt-api-key", "verySecret"),
+			DtService:        m.deptrackMock(`{"projectName": "pitc-flow-test", "projectVersion": "1.0.0", "autoCreate": true}`),
+			DtWait:           true,
+			DtFailSeverity:   "CRITICAL",
+			AllowFailure:     true,
+		},
+	)
+
+	_, err := dag.PitcFlow().Verify(ctx, result.Status())
+	if err == nil {
+		return fmt.Errorf("should fail to verify the run")
+	}
+	if !strings.Contains(err.Error(), "deptrack-gate") {
+		return fmt.Errorf("should report the failed deptrack gate: %w", err)
+	}
+
+	files, err := result.Directory().Entries(ctx, dagger.DirectoryEntriesOpts{Path: "deptrack"})
+	if err != nil {
+		return fmt.Errorf("failed to list files in directory: %w", err)
+	}
+	for _, file := range []string{"bom-upload.json", "findings.json", "violations.json"} {
+		if !slices.Contains(files, file) {
+			return fmt.Errorf("%s was missing from the deptrack results: %v", file, files)
+		}
+	}
+
+	// the gate cannot be passed by a failed upload
+	failed := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			DtAddress:        "http://deptrack:8080",
+			DtProjectName:    "pitc-flow-test",
+			DtProjectVersion: "1.0.0",
+			DtAutoCreate:     true,
+			DtAPIKey:         dag.SetSecret("dt-api-key-wrong", "wrongKey"),
+			DtService:        m.deptrackMock(`{"projectName": "pitc-flow-test", "projectVersion": "1.0.0", "autoCreate": true}`),
+			DtWait:           true,
+			DtFailSeverity:   "CRITICAL",
+			AllowFailure:     true,
+		},
+	)
+	_, err = dag.PitcFlow().Verify(ctx, failed.Status())
+	if err == nil || !strings.Contains(err.Error(), "HTTP 401") {
+		return fmt.Errorf("should fail the run on a rejected upload, got %v", err)
+	}
+
+	// the failed gate still points to its findings
+	steps, err := result.Steps(ctx)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		name, err := step.Name(ctx)
+		if err != nil {
+			return err
+		}
+		if name != "deptrack-gate" {
+			continue
+		}
+		artifacts, err := step.Artifacts(ctx)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(artifacts, "deptrack/findings.json") {
+			return fmt.Errorf("the failed deptrack gate should keep its findings as artifact, got %v", artifacts)
+		}
+	}
+
+	// the gate settings are refused unless the gate can evaluate the upload
+	_, err = dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			DtAddress:        "http://deptrack:8080",
+			DtProjectName:    "pitc-flow-test",
+			DtProjectVersion: "1.0.0",
+			DtAPIKey:         dag.SetSecret("dt-api-key", "verySecret"),
+			DtFailSeverity:   "CRITICAL",
+		},
+	).Succeeded(ctx)
+	if err == nil || !strings.Contains(err.Error(), "only fail the run when waiting") {
+		return fmt.Errorf("should refuse the deptrack severity without waiting, got %v", err)
+	}
+	_, err = dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			DtAddress:      "http://deptrack:8080",
+			DtWait:         true,
+			DtFailSeverity: "CRITICAL",
+		},
+	).Succeeded(ctx)
+	if err == nil || !strings.Contains(err.Error(), "waiting for deptrack requires") {
+		return fmt.Errorf("should refuse to wait for deptrack without uploading the SBOM, got %v", err)
+	}
+
+	return nil
+}
+
+// KmsSigning test.
+func (m *Tests) KmsSigning(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			AppContainer:     m.uniqContainer("busybox:glibc", uniq),
+			RegistryUsername: "joe",
+			RegistryPassword: dag.SetSecret("password", "verySecret"),
+			RegistryAddress:  fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			SigningMode:      "kms",
+			KmsKey:           "hashivault://cosign",
+			VaultAddress:     "http://vault:8200",
+			VaultToken:       dag.SetSecret("vault-token", "root"),
+			VaultService:     m.vaultDevServer(),
+		},
+	)
+
+	_, err := dag.PitcFlow().Verify(ctx, result.Status())
+	if err != nil {
+		return fmt.Errorf("should sign and attest with the KMS key: %w", err)
+	}
+
+	return nil
+}
+
+// KeylessSigning test.
+func (m *Tests) KeylessSigning(ctx context.Context) error {
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+
+	// a keyless signature cannot be verified without its expected signer
+	_, err := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			AppContainer:    m.uniqContainer("busybox:glibc", fmt.Sprintf("%d", time.Now().UnixNano())),
+			RegistryAddress: "ttl.sh/pitc-flow-keyless:1h",
+		},
+	).Succeeded(ctx)
+	if err == nil || !strings.Contains(err.Error(), "certificate identity and OIDC issuer") {
+		return fmt.Errorf("should refuse to publish without the expected signer, got %v", err)
+	}
+
+	return nil
+}
+
+// KeySigning test.
+func (m *Tests) KeySigning(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			AppContainer:     m.uniqContainer("busybox:glibc", uniq),
+			RegistryUsername: "joe",
+			RegistryPassword: dag.SetSecret("password", "verySecret"),
+			RegistryAddress:  fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			SigningMode:      "key",
+			CosignKey:        privateKey,
+			CosignPublicKey:  publicKey,
+		},
+	)
+
+	_, err = dag.PitcFlow().Verify(ctx, result.Status())
+	if err != nil {
+		return fmt.Errorf("should sign, attest and verify with the key: %w", err)
+	}
+	files, err := result.Directory().Entries(ctx, dagger.DirectoryEntriesOpts{Path: "verify"})
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(files, []string{"attestation-cyclonedx.json", "attestation-vuln.json", "signature.json"}) {
+		return fmt.Errorf("should contain the verification outputs, got %v", files)
+	}
+
+	return nil
+}
+
+// PlatformAttestations test.
+func (m *Tests) PlatformAttestations(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			Platforms:        []string{"linux/amd64", "linux/arm64"},
+			SbomFormats:      []string{"cyclonedx", "spdx"},
+			RegistryUsername: "joe",
+			RegistryPassword: dag.SetSecret("password", "verySecret"),
+			RegistryAddress:  fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			SigningMode:      "key",
+			CosignKey:        privateKey,
+			CosignPublicKey:  publicKey,
+		},
+	)
+
+	_, err = dag.PitcFlow().Verify(ctx, result.Status())
+	if err != nil {
+		return fmt.Errorf("should attest and verify the SBOMs of all the platforms: %w", err)
+	}
+	// the SBOM of each platform is attested to the image manifest of its platform
+	variants, err := result.Variants(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the image variants: %w", err)
+	}
+	var digests []string
+	for _, variant := range variants {
+		digest, err := variant.Digest(ctx)
+		if err != nil {
+			return err
+		}
+		digests = append(digests, digest)
+	}
+	slices.Sort(digests)
+	// each line of the verification output is an attestation envelope
+	verification, err := result.Directory().File("verify/attestation-cyclonedx.json").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("should contain the verification of the SBOMs: %w", err)
+	}
+	var subjects []string
+	for _, line := range strings.Split(strings.TrimSpace(verification), "\n") {
+		var envelope struct {
+			Payload string `json:"payload"`
+		}
+		if err := json.Unmarshal([]byte(line), &envelope); err != nil {
+			return fmt.Errorf("failed to parse the verification output: %w", err)
+		}
+		payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to decode the attestation: %w", err)
+		}
+		var statement struct {
+			Subject []struct {
+				Digest struct {
+					Sha256 string `json:"sha256"`
+				} `json:"digest"`
+			} `json:"subject"`
+		}
+		if err := json.Unmarshal(payload, &statement); err != nil {
+			return fmt.Errorf("failed to parse the attestation: %w", err)
+		}
+		for _, subject := range statement.Subject {
+			subjects = append(subjects, "sha256:"+subject.Digest.Sha256)
+		}
+	}
+	slices.Sort(subjects)
+	if len(digests) != 2 || !slices.Equal(subjects, digests) {
+		return fmt.Errorf("should attest the SBOMs to the manifests of both platforms %v, got %v", digests, subjects)
+	}
+
+	return nil
+}
+
+// Provenance test.
+func (m *Tests) Provenance(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the runtime stage requires the version 1.0.0, the unused build ID only makes the build unique
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			Dockerfile:       "docker/Dockerfile.prod",
+			BuildTarget:      "runtime",
+			BuildArgs:        []string{"VERSION=1.0.0", "BUILD_ID=" + uniq},
+			BuildSecrets:     []*dagger.Secret{dag.SetSecret("npm-token", "verySecret")},
+			RegistryUsername: "joe",
+			RegistryPassword: dag.SetSecret("password", "verySecret"),
+			RegistryAddress:  fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			SigningMode:      "key",
+			CosignKey:        privateKey,
+			CosignPublicKey:  publicKey,
+		},
+	)
+
+	_, err = dag.PitcFlow().Verify(ctx, result.Status())
+	if err != nil {
+		return fmt.Errorf("should attest and verify the provenance: %w", err)
+	}
+	provenance, err := result.Directory().File("provenance/slsa-provenance.json").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("should contain the provenance: %w", err)
+	}
+	if !strings.Contains(provenance, `"BUILD_ID": "`+uniq+`"`) || !strings.Contains(provenance, `"dockerfile": "docker/Dockerfile.prod"`) {
+		return fmt.Errorf("the provenance should describe the build, got %s", provenance)
+	}
+	// only the tools which ran are dependencies e.g. no SBOMs were merged
+	if !strings.Contains(provenance, `"uri": "docker://aquasec/trivy"`) || strings.Contains(provenance, "cyclonedx/cyclonedx-cli") {
+		return fmt.Errorf("the provenance should only list the tools used by the run, got %s", provenance)
+	}
+	_, err = result.Directory().File("verify/attestation-slsaprovenance1.json").Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("should contain the verification of the provenance: %w", err)
+	}
+
+	return nil
+}
+
+// ReportAttestations test.
+func (m *Tests) ReportAttestations(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+	lintContainer := dag.Container().
+		From("busybox:glibc").
+		WithExec([]string{"sh", "-c", "mkdir -p /tmp/lint && echo " + uniq + " > /tmp/lint/lint.txt && echo " + uniq + " > '/tmp/lint/lint report.txt'"})
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			LintContainer:    lintContainer,
+			LintReportDir:    "/tmp/lint",
+			AppContainer:     m.uniqContainer("busybox:glibc", uniq),
+			RegistryUsername: "joe",
+			RegistryPassword: dag.SetSecret("password", "verySecret"),
+			RegistryAddress:  fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			SigningMode:      "key",
+			CosignKey:        privateKey,
+			CosignPublicKey:  publicKey,
+			AttestReports:    true,
+		},
+	)
+
+	_, err = dag.PitcFlow().Verify(ctx, result.Status())
+	if err != nil {
+		return fmt.Errorf("should attest and verify the lint reports: %w", err)
+	}
+	verification, err := result.Directory().File("verify/attestation-lint.json").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("should contain the verification of the lint reports: %w", err)
+	}
+	if verification == "" {
+		return fmt.Errorf("the verification of the lint reports should not be empty")
+	}
+	var envelope struct {
+		Payload string `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(strings.Split(verification, "\n")[0]), &envelope); err != nil {
+		return fmt.Errorf("failed to parse the verification output: %w", err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return fmt.Errorf("failed to decode the attestation: %w", err)
+	}
+	var statement struct {
+		Predicate struct {
+			Reports []struct {
+				Name string `json:"name"`
+			} `json:"reports"`
+		} `json:"predicate"`
+	}
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return fmt.Errorf("failed to parse the attestation: %w", err)
+	}
+	var names []string
+	for _, report := range statement.Predicate.Reports {
+		names = append(names, report.Name)
+	}
+	// file names with spaces are kept as they are
+	if !slices.Equal(names, []string{"lint report.txt", "lint.txt"}) {
+		return fmt.Errorf("the attestation should list all the lint reports, got %v", names)
+	}
+
+	return nil
+}
+
+// Tags test.
+func (m *Tests) Tags(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+	// a git repository with the release tag v1.4.2 on HEAD
+	dir := dag.Container().
+		From("alpine/git").
+		WithDirectory("/src", dag.CurrentModule().Source().Directory("./testdata")).
+		WithWorkdir("/src").
+		WithExec([]string{"sh", "-c", "git init -q && git -c user.name=joe -c user.email=joe@example.com commit -q --allow-empty -m release && git tag v1.4.2"}).
+		Directory("/src")
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			AppContainer:     m.uniqContainer("busybox:glibc", uniq),
+			RegistryUsername: "joe",
+			RegistryPassword: dag.SetSecret("password", "verySecret"),
+			RegistryAddress:  fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			Tags:             []string{"latest", "1h"},
+			GitTags:          true,
+			SigningMode:      "key",
+			CosignKey:        privateKey,
+			CosignPublicKey:  publicKey,
+		},
+	)
+
+	tags, err := result.Tags(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the published tags: %w", err)
+	}
+	if len(tags) != 6 || !slices.Equal(tags[:5], []string{"1h", "latest", "1.4.2", "1.4", "1"}) || !strings.HasPrefix(tags[5], "sha-") {
+		return fmt.Errorf("should publish the provided and the derived tags, got %v", tags)
+	}
+
+	// all the tags point to the very same published digest
+	digest, err := result.ImageDigest(ctx)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		tagDigest, err := m.craneDigest(ctx, fmt.Sprintf("ttl.sh/pitc-flow-%s:%s", uniq, tag))
+		if err != nil {
+			return err
+		}
+		if tagDigest != digest {
+			return fmt.Errorf("the tag %s should point to the published digest %s, got %s", tag, digest, tagDigest)
+		}
+	}
+
+	return nil
+}
+
+// Mirrors test.
+func (m *Tests) Mirrors(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+	// the registries are kept running to verify the copies after the pipeline run
+	mirrorA, err := m.registry("mirror-a").Start(ctx)
+	if err != nil {
+		return err
+	}
+	defer mirrorA.Stop(ctx)
+	mirrorB, err := m.registry("mirror-b").Start(ctx)
+	if err != nil {
+		return err
+	}
+	defer mirrorB.Stop(ctx)
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			AppContainer:     m.uniqContainer("busybox:glibc", uniq),
+			RegistryUsername: "joe",
+			RegistryPassword: dag.SetSecret("password", "verySecret"),
+			RegistryAddress:  fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			SigningMode:      "key",
+			CosignKey:        privateKey,
+			CosignPublicKey:  publicKey,
+			MirrorAddresses:  []string{"mirror-a:5000/pitc-flow:1.0.0", "mirror-b:5000/customer/pitc-flow:1.0.0"},
+			MirrorServices:   []*dagger.Service{mirrorA, mirrorB},
+		},
+	)
+
+	_, err = dag.PitcFlow().Verify(ctx, result.Status())
+	if err != nil {
+		return fmt.Errorf("should publish and mirror the image: %w", err)
+	}
+	mirrors, err := result.Mirrors(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the mirrors: %w", err)
+	}
+	if len(mirrors) != 2 {
+		return fmt.Errorf("should copy the image to both mirrors, got %v", mirrors)
+	}
+	for _, mirror := range mirrors {
+		_, err = dag.Container().
+			From("cgr.dev/chainguard/cosign:latest-dev").
+			WithServiceBinding("mirror-a", mirrorA).
+			WithServiceBinding("mirror-b", mirrorB).
+			WithFile("/tmp/cosign.pub", publicKey).
+			WithExec([]string{"cosign", "verify", "--key", "/tmp/cosign.pub", "--insecure-ignore-tlog=true", "--allow-http-registry", mirror}).
+			Sync(ctx)
+		if err != nil {
+			return fmt.Errorf("should copy the signature to %s: %w", mirror, err)
+		}
+	}
+
+	return nil
+}
+
+// Promote test.
+func (m *Tests) Promote(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+	_, otherPublicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+	staging, err := m.registry("staging").Start(ctx)
+	if err != nil {
+		return err
+	}
+	defer staging.Stop(ctx)
+	production, err := m.registry("production").Start(ctx)
+	if err != nil {
+		return err
+	}
+	defer production.Stop(ctx)
+
+	// the staging image is built, signed and attested by the pipeline
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			RegistryUsername: "joe",
+			RegistryPassword: dag.SetSecret("password", "verySecret"),
+			RegistryAddress:  fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			SigningMode:      "key",
+			CosignKey:        privateKey,
+			CosignPublicKey:  publicKey,
+			MirrorAddresses:  []string{"staging:5000/pitc-flow:1.0.0"},
+			MirrorServices:   []*dagger.Service{staging},
+		},
+	)
+	_, err = dag.PitcFlow().Verify(ctx, result.Status())
+	if err != nil {
+		return fmt.Errorf("should publish the staging image: %w", err)
+	}
+	imageDigest, err := result.ImageDigest(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = dag.PitcFlow().Promote("staging:5000/pitc-flow:1.0.0", "production:5000/pitc-flow:1.0.0", dagger.PitcFlowPromoteOpts{
+		SourceService:   staging,
+		TargetService:   production,
+		SigningMode:     "key",
+		CosignPublicKey: otherPublicKey,
+	}).Target(ctx)
+	if err == nil {
+		return fmt.Errorf("should not promote an image signed with another key")
+	}
+
+	promotion := dag.PitcFlow().Promote("staging:5000/pitc-flow:1.0.0", "production:5000/pitc-flow:1.0.0", dagger.PitcFlowPromoteOpts{
+		SourceService:   staging,
+		TargetService:   production,
+		SigningMode:     "key",
+		CosignPublicKey: publicKey,
+	})
+	target, err := promotion.Target(ctx)
+	if err != nil {
+		return fmt.Errorf("should promote the signed image: %w", err)
+	}
+	if target != "production:5000/pitc-flow@"+imageDigest {
+		return fmt.Errorf("should promote the image by digest %s, got %s", imageDigest, target)
+	}
+	_, err = promotion.Directory().File("verify/attestation-slsaprovenance1.json").Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("should contain the verification of the provenance: %w", err)
+	}
+
+	return nil
+}
+
+// ImageLock test.
+func (m *Tests) ImageLock(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			Platforms:        []string{"linux/amd64", "linux/arm64"},
+			RegistryUsername: "joe",
+			RegistryPassword: dag.SetSecret("password", "verySecret"),
+			RegistryAddress:  fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			SigningMode:      "key",
+			CosignKey:        privateKey,
+			CosignPublicKey:  publicKey,
+		},
+	)
+
+	imageRef, err := result.ImageRef(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the image reference: %w", err)
+	}
+	if !strings.HasPrefix(imageRef, fmt.Sprintf("ttl.sh/pitc-flow-%s@sha256:", uniq)) {
+		return fmt.Errorf("should pin the published image by digest, got %q", imageRef)
+	}
+	reference, err := result.Directory().File("image/reference").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("should contain the image reference: %w", err)
+	}
+	if strings.TrimSpace(reference) != imageRef {
+		return fmt.Errorf("image/reference should contain %s, got %s", imageRef, reference)
+	}
+	content, err := result.Directory().File("image/image.lock").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("should contain the image lock: %w", err)
+	}
+	var lock struct {
+		Reference string `json:"reference"`
+		Platforms []struct {
+			Platform string `json:"platform"`
+			Digest   string `json:"digest"`
+		} `json:"platforms"`
+	}
+	if err := json.Unmarshal([]byte(content), &lock); err != nil {
+		return fmt.Errorf("failed to parse the image lock: %w", err)
+	}
+	if lock.Reference != imageRef || len(lock.Platforms) != 2 {
+		return fmt.Errorf("the image lock should pin the image and both platforms, got %s", content)
+	}
+
+	return nil
+}
+
+// RegistryConfig test.
+func (m *Tests) RegistryConfig(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+	// the mirror only accepts the robot account, whose credentials are only in the docker config.json
+	htpasswd := dag.Container().
+		From("httpd:2").
+		WithExec([]string{"sh", "-c", "htpasswd -Bbn robot verySecret > /tmp/htpasswd"}).
+		File("/tmp/htpasswd")
+	mirror, err := dag.Container().
+		From("registry:2").
+		WithFile("/auth/htpasswd", htpasswd).
+		WithEnvVariable("REGISTRY_AUTH", "htpasswd").
+		WithEnvVariable("REGISTRY_AUTH_HTPASSWD_REALM", "registry").
+		WithEnvVariable("REGISTRY_AUTH_HTPASSWD_PATH", "/auth/htpasswd").
+		WithExposedPort(5000).
+		AsService().
+		Start(ctx)
+	if err != nil {
+		return err
+	}
+	defer mirror.Stop(ctx)
+	config := fmt.Sprintf(`{"auths": {"secure:5000": {"auth": %q}}}`, base64.StdEncoding.EncodeToString([]byte("robot:verySecret")))
+
+	// ttl.sh is published to anonymously
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			AppContainer:    m.uniqContainer("busybox:glibc", uniq),
+			RegistryAddress: fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			SigningMode:     "key",
+			CosignKey:       privateKey,
+			CosignPublicKey: publicKey,
+			MirrorAddresses: []string{"secure:5000/pitc-flow:1.0.0"},
+			MirrorServices:  []*dagger.Service{mirror},
+			RegistryConfig:  dag.SetSecret("docker-config", config),
+		},
+	)
+
+	_, err = dag.PitcFlow().Verify(ctx, result.Status())
+	if err != nil {
+		return fmt.Errorf("should publish without credentials and mirror with the docker config.json: %w", err)
+	}
+
+	return nil
+}
+
+// TagProtection test.
+func (m *Tests) TagProtection(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+	release := m.uniqContainer("busybox:glibc", uniq)
+	publish := func(app *dagger.Container) error {
+		result := dag.PitcFlow().Flex(
+			dir,
+			dagger.PitcFlowFlexOpts{
+				AppContainer:    app,
+				RegistryAddress: fmt.Sprintf("ttl.sh/pitc-flow-%s:1.0.0", uniq),
+				Tags:            []string{"latest"},
+				ProtectTags:     true,
+				SigningMode:     "key",
+				CosignKey:       privateKey,
+				CosignPublicKey: publicKey,
+			},
+		)
+		_, err := dag.PitcFlow().Verify(ctx, result.Status())
+		return err
+	}
+
+	if err := publish(release); err != nil {
+		return fmt.Errorf("should publish the release: %w", err)
+	}
+	if err := publish(release); err != nil {
+		return fmt.Errorf("should publish the same release again: %w", err)
+	}
+	err = publish(m.uniqContainer("busybox:glibc", uniq+"-other"))
+	if err == nil || !strings.Contains(err.Error(), "refusing to overwrite") {
+		return fmt.Errorf("should refuse to overwrite the release tag with another image, got %v", err)
+	}
+
+	// the floating tags "1.4" and "1" move on to the next release, the release tags themselves are protected
+	gitRelease := func(version string) error {
+		source := dag.Container().
+			From("alpine/git").
+			WithDirectory("/src", dir).
+			WithWorkdir("/src").
+			WithExec([]string{"sh", "-c", fmt.Sprintf("git init -q && git -c user.name=joe -c user.email=joe@example.com commit -q --allow-empty -m %s && git tag v%s", version, version)}).
+			Directory("/src")
+		result := dag.PitcFlow().Flex(
+			source,
+			dagger.PitcFlowFlexOpts{
+				AppContainer:    m.uniqContainer("busybox:glibc", uniq+"-"+version),
+				RegistryAddress: fmt.Sprintf("ttl.sh/pitc-flow-floating-%s:1h", uniq),
+				GitTags:         true,
+				ProtectTags:     true,
+				MutableTags:     []string{"1h"},
+				SigningMode:     "key",
+				CosignKey:       privateKey,
+				CosignPublicKey: publicKey,
+			},
+		)
+		_, err := dag.PitcFlow().Verify(ctx, result.Status())
+		return err
+	}
+	if err := gitRelease("1.4.2"); err != nil {
+		return fmt.Errorf("should publish the release 1.4.2: %w", err)
+	}
+	if err := gitRelease("1.4.3"); err != nil {
+		return fmt.Errorf("should move the floating tags to the release 1.4.3: %w", err)
+	}
+
+	// the forced copy to a mirror must not overwrite its tag either
+	mirror, err := m.registry("mirror").Start(ctx)
+	if err != nil {
+		return err
+	}
+	defer mirror.Stop(ctx)
+	mirrorRelease := func(app *dagger.Container, tag string) error {
+		result := dag.PitcFlow().Flex(
+			dir,
+			dagger.PitcFlowFlexOpts{
+				AppContainer:    app,
+				RegistryAddress: fmt.Sprintf("ttl.sh/pitc-flow-mirrored-%s:%s", uniq, tag),
+				MirrorAddresses: []string{"mirror:5000/pitc-flow:1.0.0"},
+				MirrorServices:  []*dagger.Service{mirror},
+				ProtectTags:     true,
+				SigningMode:     "key",
+				CosignKey:       privateKey,
+				CosignPublicKey: publicKey,
+			},
+		)
+		_, err := dag.PitcFlow().Verify(ctx, result.Status())
+		return err
+	}
+	if err := mirrorRelease(release, "first"); err != nil {
+		return fmt.Errorf("should mirror the release: %w", err)
+	}
+	err = mirrorRelease(m.uniqContainer("busybox:glibc", uniq+"-mirrored"), "second")
+	if err == nil || !strings.Contains(err.Error(), "refusing to overwrite") {
+		return fmt.Errorf("should refuse to overwrite the tag of the mirror with another image, got %v", err)
+	}
+
+	return nil
+}
+
+// Quarantine test.
+func (m *Tests) Quarantine(ctx context.Context) error {
+	uniq := fmt.Sprintf("%d", time.Now().UnixNano())
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+	privateKey, publicKey, err := m.cosignKeyPair(ctx)
+	if err != nil {
+		return err
+	}
+	quarantine := func(app *dagger.Container, name string) *dagger.PitcFlowPipelineResult {
+		return dag.PitcFlow().Flex(
+			dir,
+			dagger.PitcFlowFlexOpts{
+				AppContainer:         app,
+				RegistryAddress:      fmt.Sprintf("ttl.sh/pitc-flow-%s-%s:1h", name, uniq),
+				QuarantineRepository: fmt.Sprintf("ttl.sh/pitc-flow-quarantine-%s-%s", name, uniq),
+				VulnSeverity:         "CRITICAL",
+				SigningMode:          "key",
+				CosignKey:            privateKey,
+				CosignPublicKey:      publicKey,
+				AllowFailure:         true,
+			},
+		)
+	}
+
+	released := quarantine(m.uniqContainer("busybox:glibc", uniq), "released")
+	_, err = dag.PitcFlow().Verify(ctx, released.Status())
+	if err != nil {
+		return fmt.Errorf("should release the quarantined image: %w", err)
+	}
+	imageRef, err := released.ImageRef(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(imageRef, fmt.Sprintf("ttl.sh/pitc-flow-released-%s@sha256:", uniq)) {
+		return fmt.Errorf("should release the image to the registry address, got %q", imageRef)
+	}
+	quarantineRef, err := released.QuarantineRef(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.HasSuffix(quarantineRef, "@"+strings.Split(imageRef, "@")[1]) {
+		return fmt.Errorf("should release the quarantined digest %s, got %s", quarantineRef, imageRef)
+	}
+
+	// outdated image with known critical vulnerabilities
+	rejected := quarantine(m.uniqContainer("alpine:3.9", uniq), "rejected")
+	imageRef, err = rejected.ImageRef(ctx)
+	if err != nil {
+		return err
+	}
+	if imageRef != "" {
+		return fmt.Errorf("should not release a vulnerable image, got %q", imageRef)
+	}
+	for name, want := range map[string]string{"sign": "skipped", "release": "skipped", "reject": "passed"} {
+		status, _, err := m.stepStatus(ctx, rejected, name)
+		if err != nil {
+			return err
+		}
+		if status != want {
+			return fmt.Errorf("the step %s of a vulnerable image should be %s, got %s", name, want, status)
+		}
+	}
+
+	// the rejected image must not be trusted when it is copied out of the quarantine
+	quarantineRef, err = rejected.QuarantineRef(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = dag.Container().
+		From("cgr.dev/chainguard/cosign:latest-dev").
+		WithFile("/tmp/cosign.pub", publicKey).
+		WithExec([]string{"cosign", "verify", "--key", "/tmp/cosign.pub", "--insecure-ignore-tlog=true", quarantineRef}).
+		Sync(ctx)
+	if err == nil {
+		return fmt.Errorf("should not sign the rejected image %s", quarantineRef)
+	}
+
+	// the quarantine is accessed with the credentials of the registry
+	_, err = dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{
+			AppContainer:         m.uniqContainer("busybox:glibc", uniq),
+			RegistryAddress:      fmt.Sprintf("ttl.sh/pitc-flow-%s:1h", uniq),
+			QuarantineRepository: "quarantine.example.com/pitc-flow",
+		},
+	).Succeeded(ctx)
+	if err == nil || !strings.Contains(err.Error(), "must be on the registry ttl.sh") {
+		return fmt.Errorf("should refuse a quarantine on another registry, got %v", err)
+	}
+
+	return nil
+}
+
+// VulnerabilityGate test.
+func (m *Tests) VulnerabilityGate(ctx context.Context) error {
+	// outdated image with known critical vulnerabilities
+	appContainer := m.uniqContainer("alpine:3.9", fmt.Sprintf("%d", time.Now().UnixNano()))
+	dir := dag.CurrentModule().Source().Directory("./testdata")
+
+	result := dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{AppContainer: appContainer, VulnSeverity: "CRITICAL", AllowFailure: true},
+	)
+
+	succeeded, err := result.Succeeded(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the pipeline status: %w", err)
+	}
+	if succeeded {
+		return fmt.Errorf("should fail the vulnerability gate")
+	}
+
+	_, err = dag.PitcFlow().Verify(ctx, result.Status())
+	if err == nil {
+		return fmt.Errorf("should fail to verify the run")
+	}
+	if !strings.Contains(err.Error(), "vuln-gate") {
+		return fmt.Errorf("should report the failed vulnerability gate: %w", err)
+	}
+
+	// without allowing failures the call itself fails
+	_, err = dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{AppContainer: appContainer, VulnSeverity: "CRITICAL"},
+	).Succeeded(ctx)
+	if err == nil || !strings.Contains(err.Error(), "vuln-gate") {
+		return fmt.Errorf("should fail the call on the failed vulnerability gate, got %v", err)
+	}
+
+	// counting only fixable vulnerabilities needs a gate to count for
+	_, err = dag.PitcFlow().Flex(
+		dir,
+		dagger.PitcFlowFlexOpts{AppContainer: appContainer, VulnFixableOnly: true},
+	).Succeeded(ctx)
+	if err == nil || !strings.Contains(err.Error(), "fixable vulnerabilities") {
+		return fmt.Errorf("should reject counting only fixable vulnerabilities without a gate, got %v", err)
+	}
+
+	return nil
 }
 
 func (m *Tests) Verify(ctx context.Context) error {
-	success := dag.CurrentModule().Source().Directory(".").WithNewFile("status.txt", "").File("status.txt")
+	success := dag.CurrentModule().Source().Directory(".").
+		WithNewFile("status.json", `{"version":1,"succeeded":true,"steps":[{"name":"lint","status":"passed"},{"name":"deptrack","status":"soft-failed","error":"unreachable"}]}`).
+		File("status.json")
 	_, err := dag.PitcFlow().Verify(ctx, success)
 	if err != nil {
 		return fmt.Errorf("failed to verify succesfull run: %w", err)
 	}
 
-	failure := dag.CurrentModule().Source().Directory(".").WithNewFile("status.txt", "fail").File("status.txt")
+	failure := dag.CurrentModule().Source().Directory(".").
+		WithNewFile("status.json", `{"version":1,"succeeded":false,"steps":[{"name":"lint","status":"failed","error":"fail"}]}`).
+		File("status.json")
 	_, err = dag.PitcFlow().Verify(ctx, failure)
 	if err == nil {
-		return fmt.Errorf("failed to verify failed run: %w", err)
+		return fmt.Errorf("failed to verify failed run")
+	}
+
+	invalid := dag.CurrentModule().Source().Directory(".").WithNewFile("status.json", "fail").File("status.json")
+	_, err = dag.PitcFlow().Verify(ctx, invalid)
+	if err == nil {
+		return fmt.Errorf("failed to verify invalid status file")
 	}
 
 	return nil
@@ -162,7 +1363,7 @@ func (m *Tests) callFull(_ context.Context, opts ...dagger.PitcFlowFullOpts) err
 	dtAddress := "ttl.sh"
 	dtProjectUUID := "12345678-1234-1234-1234-123456789012"
 
-	directory := dag.PitcFlow().Full(
+	result := dag.PitcFlow().Full(
 		dir,
 		lintContainer,
 		lintReportDir,
@@ -181,22 +1382,108 @@ func (m *Tests) callFull(_ context.Context, opts ...dagger.PitcFlowFullOpts) err
 		opts...,
 	)
 
-	if directory == nil {
-		return fmt.Errorf("should run the pipeline and return a directory")
+	if result == nil {
+		return fmt.Errorf("should run the pipeline and return a result")
 	}
 
-	files, err := directory.Entries(context.Background())
+	files, err := result.Directory().Entries(context.Background())
 	if err != nil {
 		return fmt.Errorf("failed to list files in directory: %w", err)
 	}
 
 	for _, file := range files {
-		if strings.Contains(file, "status.txt") {
+		if strings.Contains(file, "status.json") {
 			return nil
 		}
 	}
 
-	return fmt.Errorf("status.txt was missing from all files: %v", files)
+	return fmt.Errorf("status.json was missing from all files: %v", files)
+}
+
+// stepStatus returns the status and the error of the step with the provided name.
+func (m *Tests) stepStatus(ctx context.Context, result *dagger.PitcFlowPipelineResult, name string) (string, string, error) {
+	steps, err := result.Steps(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	for _, step := range steps {
+		stepName, err := step.Name(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		if stepName != name {
+			continue
+		}
+		status, err := step.Status(ctx)
+		if err != nil {
+			return "", "", err
+		}
+		stepError, err := step.Error(ctx)
+		return status, stepError, err
+	}
+	return "", "", fmt.Errorf("the step %s is missing", name)
+}
+
+// deptrackMock returns a service standing in for Dependency-Track.
+func (m *Tests) deptrackMock(expectedProject string) *dagger.Service {
+	return dag.Container().
+		From("python:3-alpine").
+		WithFile("/mock/deptrack.py", dag.CurrentModule().Source().File("./mocks/deptrack.py")).
+		WithEnvVariable("EXPECTED_PROJECT", expectedProject).
+		WithExposedPort(8080).
+		AsService(dagger.ContainerAsServiceOpts{Args: []string{"python", "/mock/deptrack.py"}})
+}
+
+// craneDigest returns the digest the image reference resolves to in its registry.
+func (m *Tests) craneDigest(ctx context.Context, reference string) (string, error) {
+	digest, err := dag.Container().
+		From("cgr.dev/chainguard/crane:latest-dev").
+		// the tags must be resolved on each run
+		WithEnvVariable("CACHE_BUSTER", time.Now().String()).
+		WithExec([]string{"crane", "digest", reference}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the digest of %s: %w", reference, err)
+	}
+	return strings.TrimSpace(digest), nil
+}
+
+// cosignKeyPair returns a new cosign key pair without password.
+func (m *Tests) cosignKeyPair(ctx context.Context) (*dagger.Secret, *dagger.File, error) {
+	keys := dag.Container().
+		From("cgr.dev/chainguard/cosign:latest-dev").
+		WithWorkdir("/tmp/keys").
+		WithEnvVariable("COSIGN_PASSWORD", "").
+		WithExec([]string{"cosign", "generate-key-pair"}).
+		Directory("/tmp/keys")
+	privateKey, err := keys.File("cosign.key").Contents(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dag.SetSecret("cosign-key", privateKey), keys.File("cosign.pub"), nil
+}
+
+// registry returns a local registry, the name distinguishes the otherwise identical services.
+func (m *Tests) registry(name string) *dagger.Service {
+	return dag.Container().
+		From("registry:2").
+		WithEnvVariable("REGISTRY_NAME", name).
+		WithExposedPort(5000).
+		AsService()
+}
+
+// vaultDevServer returns a Hashicorp Vault dev server with the transit key "cosign".
+func (m *Tests) vaultDevServer() *dagger.Service {
+	script := `vault server -dev -dev-root-token-id=root -dev-listen-address=0.0.0.0:8200 &
+export VAULT_ADDR=http://127.0.0.1:8200 VAULT_TOKEN=root
+until vault status > /dev/null; do sleep 1; done
+vault secrets enable transit
+vault write -f transit/keys/cosign type=ecdsa-p256
+wait`
+	return dag.Container().
+		From("hashicorp/vault").
+		WithExposedPort(8200).
+		AsService(dagger.ContainerAsServiceOpts{Args: []string{"sh", "-c", script}})
 }
 
 func (m *Tests) uniqContainer(image string, randomString string) *dagger.Container {
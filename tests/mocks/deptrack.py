@@ -0,0 +1,62 @@
+# Minimal Dependency-Track API standing in for a real instance, reports one critical finding.
+# The BOM uploads must identify the project exactly as the JSON object in EXPECTED_PROJECT.
+import json
+import os
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+API_KEY = "verySecret"
+EXPECTED_PROJECT = json.loads(os.environ.get("EXPECTED_PROJECT", "{}"))
+PROJECT = "12345678-1234-1234-1234-123456789012"
+TOKEN = "87654321-4321-4321-4321-210987654321"
+
+FINDING = {
+    "component": {"name": "openssl", "version": "1.1.1"},
+    "vulnerability": {"vulnId": "CVE-2022-0778", "severity": "CRITICAL"},
+    "analysis": {"isSuppressed": False},
+}
+
+
+class Handler(BaseHTTPRequestHandler):
+    def reply(self, status, body):
+        payload = json.dumps(body).encode()
+        self.send_response(status)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(payload)))
+        self.end_headers()
+        self.wfile.write(payload)
+
+    def authorized(self):
+        if self.headers.get("X-Api-Key") != API_KEY:
+            self.reply(401, {"message": "invalid API key"})
+            return False
+        return True
+
+    def do_PUT(self):
+        if not self.authorized():
+            return
+        request = json.loads(self.rfile.read(int(self.headers.get("Content-Length", 0))))
+        if self.path != "/api/v1/bom" or not request.get("bom"):
+            self.reply(400, {"message": "invalid BOM upload"})
+            return
+        project = {key: value for key, value in request.items() if key != "bom"}
+        if project != EXPECTED_PROJECT:
+            self.reply(400, {"message": f"unexpected project {project}, expected {EXPECTED_PROJECT}"})
+            return
+        self.reply(200, {"token": TOKEN})
+
+    def do_GET(self):
+        if not self.authorized():
+            return
+        if self.path == f"/api/v1/bom/token/{TOKEN}":
+            self.reply(200, {"processing": False})
+        elif self.path.startswith("/api/v1/project/lookup"):
+            self.reply(200, {"uuid": PROJECT})
+        elif self.path == f"/api/v1/finding/project/{PROJECT}":
+            self.reply(200, [FINDING])
+        elif self.path == f"/api/v1/violation/project/{PROJECT}":
+            self.reply(200, [])
+        else:
+            self.reply(404, {"message": "not found"})
+
+
+HTTPServer(("0.0.0.0", 8080), Handler).serve_forever()